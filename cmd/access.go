@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+)
+
+// resolveAccessControl replaces the names of shared lists with
+// the addresses in them
+func resolveAccessControl(access *AccessControl) *AccessControl {
+	if access == nil {
+		return nil
+	}
+
+	return &AccessControl{
+		Allow: resolveAccessList(access.Allow),
+		Deny:  resolveAccessList(access.Deny),
+	}
+}
+
+func resolveAccessList(entries []string) []string {
+	var addresses []string
+
+	for _, entry := range entries {
+		list, ok := getSettings().AccessLists[entry]
+		if !ok {
+			addresses = append(addresses, entry)
+			continue
+		}
+		addresses = append(addresses, list...)
+	}
+
+	return addresses
+}
+
+// validateAccessControl should be called after the lists are resolved
+func validateAccessControl(access *AccessControl) error {
+	if access == nil {
+		return nil
+	}
+
+	for _, entry := range append(access.Allow, access.Deny...) {
+		if entry == "all" {
+			continue
+		}
+
+		if validateAddress(entry) != nil {
+			return fmt.Errorf(
+				"%q is not an IP, CIDR or the name of an access list",
+				entry,
+			)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/stephenafamo/warden/models"
+	"github.com/volatiletech/sqlboiler/queries/qm"
+)
+
+// accessLogDir only has the logs of the services, so removing a
+// log never removes access.log or error.log
+const accessLogDir = "/var/log/nginx/services"
+
+// jsonLogFormat is the warden_json log format.
+// $warden_service is set in the server blocks of the services
+const jsonLogFormat = `{"time":"$time_iso8601",` +
+	`"service":"$warden_service",` +
+	`"request_id":"$request_id",` +
+	`"remote_addr":"$remote_addr",` +
+	`"host":"$host",` +
+	`"method":"$request_method",` +
+	`"uri":"$request_uri",` +
+	`"protocol":"$server_protocol",` +
+	`"status":$status,` +
+	`"body_bytes_sent":$body_bytes_sent,` +
+	`"request_time":$request_time,` +
+	`"upstream_addr":"$upstream_addr",` +
+	`"upstream_status":"$upstream_status",` +
+	`"upstream_response_time":"$upstream_response_time",` +
+	`"referer":"$http_referer",` +
+	`"user_agent":"$http_user_agent",` +
+	`"forwarded_for":"$http_x_forwarded_for"}`
+
+// JsonLogFormat is used by the nginx.conf template
+func (NginxConfTemplateStruct) JsonLogFormat() string {
+	return jsonLogFormat
+}
+
+// LogFormat is the name of the log format used by the access log
+func (a AccessLog) LogFormat() string {
+	if a.Format == "" || a.Format == "json" {
+		return "warden_json"
+	}
+
+	return a.Format
+}
+
+// SamplePercent is the percentage of requests to log for
+// split_clients. Empty if all requests are logged
+func (a AccessLog) SamplePercent() string {
+	if a.Sample == 0 || a.Sample >= 100 {
+		return ""
+	}
+
+	return strconv.FormatFloat(float64(a.Sample), 'f', -1, 64) + "%"
+}
+
+// AccessLogCondition is the variable used in the if parameter of
+// the access log. Empty if every request is logged
+func (c ConfigTemplateStruct) AccessLogCondition() string {
+	switch {
+	case c.AccessLog.ErrorsOnly && c.AccessLog.SamplePercent() != "":
+		return "$warden_log_" + c.Variable
+	case c.AccessLog.ErrorsOnly:
+		return "$warden_log_errors_" + c.Variable
+	case c.AccessLog.SamplePercent() != "":
+		return "$warden_log_sample_" + c.Variable
+	default:
+		return ""
+	}
+}
+
+// defaultAccessLogPath does not change when the service is
+// reconfigured, so the log is kept
+func defaultAccessLogPath(fileName, serviceName string) string {
+	return filepath.Join(
+		accessLogDir,
+		cacheDirName(fileName)+"."+cacheDirName(serviceName)+".log",
+	)
+}
+
+// trackAccessLog adds the log file to the files of the service, so it
+// is removed along with the service.
+// If the path is already tracked, e.g. by an old version of the
+// service, it is moved to this service
+func trackAccessLog(ctx context.Context, db *sql.DB, s *models.Service, path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	ngf, err := models.NginxConfigFiles(
+		models.NginxConfigFileWhere.Path.EQ(path),
+	).One(ctx, db)
+	if err == sql.ErrNoRows {
+		return s.AddNginxConfigFiles(ctx, db, true, &models.NginxConfigFile{
+			Type:         "log",
+			Path:         path,
+			LastModified: s.LastModified,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.AddNginxConfigFiles(ctx, db, false, ngf)
+}
+
+// accessLogsInUse are the log files of the current services.
+// They are not removed when an old version of a service is cleaned up
+func accessLogsInUse(db *sql.DB) (map[string]bool, error) {
+	services, err := models.Services(
+		qm.Load(models.ServiceRels.File),
+		models.ServiceWhere.FileID.IsNotNull(),
+	).All(context.Background(), db)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := map[string]bool{}
+	for _, s := range services {
+		config := getFullConfig(s)
+		if config.AccessLog != nil {
+			paths[config.AccessLog.Path] = true
+		}
+	}
+
+	return paths, nil
+}
+
+func validateAccessLog(config ConfigTemplateStruct) error {
+	accessLog := config.AccessLog
+	if accessLog == nil {
+		return nil
+	}
+
+	if strings.ToLower(config.Type) != "http" {
+		return fmt.Errorf("access logs are only for http services")
+	}
+
+	path := filepath.Clean(accessLog.Path)
+	if !strings.HasPrefix(path, accessLogDir+"/") {
+		return fmt.Errorf("access log %q must be in %s", accessLog.Path, accessLogDir)
+	}
+
+	format := accessLog.LogFormat()
+	if _, ok := getSettings().LogFormats[format]; !ok && format != "warden_json" && format != "combined" {
+		return fmt.Errorf("unknown log format %q", accessLog.Format)
+	}
+
+	if accessLog.Buffer != "" && !nginxSize.MatchString(accessLog.Buffer) {
+		return fmt.Errorf("invalid access log buffer size %q", accessLog.Buffer)
+	}
+
+	if accessLog.Flush != "" && !nginxTime.MatchString(accessLog.Flush) {
+		return fmt.Errorf("invalid access log flush time %q", accessLog.Flush)
+	}
+
+	if accessLog.Flush != "" && accessLog.Buffer == "" {
+		return fmt.Errorf("the access log needs a Buffer to use Flush")
+	}
+
+	if accessLog.Sample < 0 || accessLog.Sample > 100 {
+		return fmt.Errorf("the access log sample must be between 0 and 100")
+	}
+
+	return nil
+}
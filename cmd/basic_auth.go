@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+const htpasswdDir = "/etc/nginx/conf.d/htpasswd"
+
+// htpasswdContents builds the user file for a BasicAuth.
+// Plaintext passwords are hashed with SHA-512 crypt,
+// which the glibc crypt used by nginx supports
+func htpasswdContents(auth BasicAuth) ([]byte, error) {
+	var b bytes.Buffer
+
+	for _, user := range auth.Users {
+		hash := user.Hash
+
+		if user.PasswordFile != "" {
+			password, err := ioutil.ReadFile(user.PasswordFile)
+			if err != nil {
+				return nil, err
+			}
+
+			hash, err = hashPassword(strings.TrimRight(string(password), "\r\n"))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		fmt.Fprintf(&b, "%s:%s\n", user.Name, hash)
+	}
+
+	return b.Bytes(), nil
+}
+
+func hashPassword(password string) (string, error) {
+	// Read from stdin so the password is not in the process list
+	cmd := exec.Command("openssl", "passwd", "-6", "-stdin")
+	cmd.Stdin = strings.NewReader(password)
+
+	// Warnings on stderr must not end up in the htpasswd file
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf(
+			"Can't hash password: %s: %s",
+			err,
+			stderr.Bytes(),
+		)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+func validateBasicAuth(auth *BasicAuth) error {
+	if auth == nil {
+		return nil
+	}
+
+	if len(auth.Users) == 0 {
+		return fmt.Errorf("basic auth needs at least one user")
+	}
+
+	for _, user := range auth.Users {
+		if user.Name == "" || strings.Contains(user.Name, ":") {
+			return fmt.Errorf("invalid basic auth user name %q", user.Name)
+		}
+
+		if (user.Hash == "") == (user.PasswordFile == "") {
+			return fmt.Errorf(
+				"basic auth user %q must have exactly one of Hash or PasswordFile",
+				user.Name,
+			)
+		}
+
+		if user.PasswordFile != "" {
+			_, err := ioutil.ReadFile(user.PasswordFile)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
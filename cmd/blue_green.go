@@ -0,0 +1,419 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/stephenafamo/warden/models"
+	"github.com/volatiletech/sqlboiler/queries/qm"
+)
+
+var switchFile string
+
+var switchCmd = &cobra.Command{
+	Use:   "switch <service> <color>",
+	Short: "Send all the traffic of a service to another color",
+	Long: "Send all the traffic of a blue/green service to the upstream " +
+		"servers of another color. It is kept when warden is restarted",
+	Args: cobra.ExactArgs(2),
+	RunE: switchFunc,
+}
+
+func init() {
+	switchCmd.Flags().StringVar(
+		&switchFile, "file", "",
+		"path of the config file, if several files have the service",
+	)
+	rootCmd.AddCommand(switchCmd)
+}
+
+// colorSwitch is the state needed to undo a switch
+type colorSwitch struct {
+	service     *models.Service
+	oldColor    string
+	path        string
+	oldContents []byte
+}
+
+func switchFunc(cmd *cobra.Command, args []string) error {
+	name, color := args[0], args[1]
+
+	db, err := sql.Open("sqlite3", getSettings().DbPath+"?_fk=1")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// The rendered config must use the same modules as the running warden
+	err = detectModules()
+	if err != nil {
+		return err
+	}
+
+	// Report a broken file here instead of failing to render
+	_, err = readActiveColors()
+	if err != nil {
+		return err
+	}
+
+	services, err := findServices(db, name, switchFile)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range services {
+		config := getFullConfig(s)
+		if config.BlueGreen == nil {
+			return fmt.Errorf("service %q in %q has no BlueGreen upstreams", s.Name, s.R.File.Path)
+		}
+
+		set, ok := config.BlueGreen.Colors[color]
+		if !ok {
+			return fmt.Errorf("service %q in %q has no color %q", s.Name, s.R.File.Path, color)
+		}
+
+		ok, unreachable := pingServers(set.Upstream)
+		if !ok {
+			return fmt.Errorf("cannot reach upstream %q of color %q", unreachable, color)
+		}
+	}
+
+	var switches []colorSwitch
+	for _, s := range services {
+		sw, err := switchColor(db, s, color)
+		if err != nil {
+			undoColorSwitches(switches)
+			return err
+		}
+		switches = append(switches, sw)
+	}
+
+	err = testNginxConfig()
+	if err != nil {
+		undoColorSwitches(switches)
+		return err
+	}
+
+	return reloadNginx()
+}
+
+// findServices are the configured services with a name,
+// optionally only from a single file
+func findServices(db *sql.DB, name, filePath string) (models.ServiceSlice, error) {
+	services, err := models.Services(
+		qm.Load(models.ServiceRels.File),
+		models.ServiceWhere.Name.EQ(name),
+		models.ServiceWhere.FileID.IsNotNull(),
+	).All(context.Background(), db)
+	if err != nil {
+		return nil, err
+	}
+
+	var found models.ServiceSlice
+	for _, s := range services {
+		if filePath == "" || s.R.File.Path == filePath {
+			found = append(found, s)
+		}
+	}
+
+	if len(found) == 0 && filePath != "" {
+		return nil, fmt.Errorf("no service named %q in %q", name, filePath)
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no service named %q", name)
+	}
+
+	return found, nil
+}
+
+// switchColor stores the new color and rewrites the http config of
+// the service. The https config only refers to the upstream by name,
+// so it does not change
+func switchColor(db *sql.DB, s *models.Service, color string) (colorSwitch, error) {
+	sw := colorSwitch{service: s}
+
+	config := getFullConfig(s)
+	sw.oldColor = config.ActiveColor
+
+	err := setActiveColor(s, color)
+	if err != nil {
+		return sw, err
+	}
+
+	ngf, err := s.NginxConfigFiles(
+		models.NginxConfigFileWhere.Type.EQ("http"),
+	).One(context.Background(), db)
+	if err == sql.ErrNoRows {
+		// Not configured yet, the new color is used when it is
+		return sw, nil
+	}
+	if err != nil {
+		return sw, err
+	}
+
+	sw.path = ngf.Path
+	sw.oldContents, err = ioutil.ReadFile(ngf.Path)
+	if err != nil {
+		return sw, err
+	}
+
+	// Keep the mirrors as they were configured by warden, since the
+	// https config uses their upstream blocks
+	config = getFullConfig(s)
+	removeMirrorsNotIn(&config, sw.oldContents)
+
+	contents, err := renderHttpConfig(config, s)
+	if err != nil {
+		return sw, err
+	}
+
+	err = ioutil.WriteFile(ngf.Path, contents, 0644)
+	if err != nil {
+		return sw, err
+	}
+
+	log.Printf("SWITCHED %s IN %s TO %s\n", s.Name, s.R.File.Path, color)
+	return sw, nil
+}
+
+func undoColorSwitches(switches []colorSwitch) {
+	for _, sw := range switches {
+		err := setActiveColor(sw.service, sw.oldColor)
+		if err != nil {
+			log.Println(err)
+		}
+
+		if sw.path == "" {
+			continue
+		}
+
+		err = ioutil.WriteFile(sw.path, sw.oldContents, 0644)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// renderHttpConfig renders the http config of a service for its state
+func renderHttpConfig(config ConfigTemplateStruct, s *models.Service) ([]byte, error) {
+	name := "httpBase"
+	if s.State == stateConfigured && config.Ssl && config.HttpsOnly {
+		name = "httptoHttps"
+	}
+
+	var b bytes.Buffer
+	err := t.ExecuteTemplate(&b, name, config)
+	return b.Bytes(), err
+}
+
+// activeColors are the colors set with `warden switch`,
+// by config file path and service name
+type activeColors map[string]map[string]string
+
+// activeColorsPath is outside the database, which is removed when
+// warden starts, so switched colors are kept across restarts
+func activeColorsPath() string {
+	return filepath.Join(getSettings().StateDir, "active_colors.json")
+}
+
+func readActiveColors() (activeColors, error) {
+	colors := activeColors{}
+
+	contents, err := ioutil.ReadFile(activeColorsPath())
+	if os.IsNotExist(err) {
+		return colors, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(contents, &colors)
+	if err != nil {
+		return nil, fmt.Errorf("invalid active colors in %q: %s", activeColorsPath(), err)
+	}
+
+	return colors, nil
+}
+
+// getActiveColor is the color set with `warden switch`, or the
+// default color of the service
+func getActiveColor(s *models.Service, blueGreen BlueGreen) (string, error) {
+	colors, err := readActiveColors()
+	if err != nil {
+		return "", err
+	}
+
+	color, ok := colors[s.R.File.Path][s.Name]
+	if !ok {
+		return blueGreen.Active, nil
+	}
+
+	// The color may have been removed from the file since the switch
+	if _, ok := blueGreen.Colors[color]; !ok {
+		return blueGreen.Active, nil
+	}
+
+	return color, nil
+}
+
+// setActiveColor writes the colors to a temporary file first,
+// so warden never reads a partly written file
+func setActiveColor(s *models.Service, color string) error {
+	colors, err := readActiveColors()
+	if err != nil {
+		return err
+	}
+
+	if colors[s.R.File.Path] == nil {
+		colors[s.R.File.Path] = map[string]string{}
+	}
+	colors[s.R.File.Path][s.Name] = color
+
+	contents, err := json.MarshalIndent(colors, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := activeColorsPath()
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path+".tmp", contents, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func pingServers(servers []UpstreamServer) (bool, string) {
+	for _, u := range servers {
+		host := strings.Split(u.Address, ":")[0]
+
+		log.Printf("PINGING %q\n", host)
+
+		if !canPing(host) {
+			return false, host
+		}
+	}
+
+	return true, ""
+}
+
+func canPing(host string) bool {
+	cmd := exec.Command("ping", "-c", "1", host)
+	return cmd.Run() == nil
+}
+
+// unreachableColors are the colors that failed the last check, by
+// config file path, service and color, so only changes are logged
+var unreachableColors = map[string]string{}
+
+// checkBlueGreenColors pings the upstream servers of every color of
+// the configured blue/green services, and logs the colors that
+// cannot be switched to
+func checkBlueGreenColors(db *sql.DB) {
+	defer r(db)
+
+	services, err := models.Services(
+		qm.Load(models.ServiceRels.File),
+		models.ServiceWhere.FileID.IsNotNull(),
+		models.ServiceWhere.State.EQ(stateConfigured),
+	).All(context.Background(), db)
+	if err != nil {
+		panic(err)
+	}
+
+	checked := map[string]bool{}
+	for _, s := range services {
+		config := getFullConfig(s)
+		if config.BlueGreen == nil {
+			continue
+		}
+
+		for color, set := range config.BlueGreen.Colors {
+			key := s.R.File.Path + ":" + s.Name + ":" + color
+			checked[key] = true
+
+			unreachable := ""
+			for _, u := range set.Upstream {
+				host := strings.Split(u.Address, ":")[0]
+				if !canPing(host) {
+					unreachable = host
+					break
+				}
+			}
+
+			if unreachable != "" && unreachableColors[key] == "" {
+				log.Printf(
+					"COLOR %s OF %s IN %s IS DOWN: cannot reach %q\n",
+					color, s.Name, s.R.File.Path, unreachable,
+				)
+			}
+
+			if unreachable == "" && unreachableColors[key] != "" {
+				log.Printf("COLOR %s OF %s IN %s IS UP\n", color, s.Name, s.R.File.Path)
+			}
+
+			unreachableColors[key] = unreachable
+		}
+	}
+
+	// Forget the services and colors that were removed
+	for key := range unreachableColors {
+		if !checked[key] {
+			delete(unreachableColors, key)
+		}
+	}
+}
+
+var colorName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func validateBlueGreen(config ConfigTemplateStruct) error {
+	blueGreen := config.BlueGreen
+	if blueGreen == nil {
+		return nil
+	}
+
+	if strings.ToLower(config.Type) != "http" {
+		return fmt.Errorf("BlueGreen upstreams are only for http services")
+	}
+
+	if len(config.Upstream) > 0 || config.Split != nil {
+		return fmt.Errorf("a service with BlueGreen upstreams can not have an Upstream or a Split")
+	}
+
+	if len(blueGreen.Colors) < 2 {
+		return fmt.Errorf("BlueGreen needs at least 2 colors")
+	}
+
+	for name, set := range blueGreen.Colors {
+		if !colorName.MatchString(name) {
+			return fmt.Errorf("invalid color name %q", name)
+		}
+
+		if len(set.Upstream) == 0 {
+			return fmt.Errorf("color %q has no upstream servers", name)
+		}
+	}
+
+	if _, ok := blueGreen.Colors[blueGreen.Active]; !ok {
+		return fmt.Errorf("the active color %q is not one of the colors", blueGreen.Active)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stephenafamo/warden/models"
+)
+
+func TestActiveColor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer withSettings(Settings{StateDir: dir})()
+
+	s := &models.Service{ID: 1, Name: "api"}
+	s.R = s.R.NewStruct()
+	s.R.File = &models.File{Name: "site", Path: "/docker/config/site.toml"}
+
+	blueGreen := BlueGreen{
+		Active: "blue",
+		Colors: map[string]UpstreamSet{"blue": {}, "green": {}},
+	}
+
+	color, err := getActiveColor(s, blueGreen)
+	if err != nil || color != "blue" {
+		t.Fatalf("expected blue before a switch, got %q, %v", color, err)
+	}
+
+	err = setActiveColor(s, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	color, err = getActiveColor(s, blueGreen)
+	if err != nil || color != "green" {
+		t.Fatalf("expected green after a switch, got %q, %v", color, err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "active_colors.json"), []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = getActiveColor(s, blueGreen)
+	if err == nil {
+		t.Fatal("expected an error for an invalid file")
+	}
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/stephenafamo/warden/models"
+)
+
+const (
+	cacheDir        = "/var/cache/nginx/warden"
+	cacheZonesPath  = "/etc/nginx/conf.d/global/cache_zones.conf"
+	defaultCacheKey = "$scheme$request_method$host$request_uri"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the response cache of services",
+}
+
+var cachePurgeCmd = &cobra.Command{
+	Use:   "purge <service>",
+	Short: "Remove all cached responses of a service",
+	Long:  "Remove all cached responses of every service with the given name",
+	Args:  cobra.ExactArgs(1),
+	RunE:  cachePurgeFunc,
+}
+
+func init() {
+	cacheCmd.AddCommand(cachePurgeCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
+
+func cachePurgeFunc(cmd *cobra.Command, args []string) error {
+	dirs, err := filepath.Glob(filepath.Join(cacheDir, "*", cacheDirName(args[0])))
+	if err != nil {
+		return err
+	}
+
+	if len(dirs) == 0 {
+		return fmt.Errorf("no cache found for service %q", args[0])
+	}
+
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			err = os.RemoveAll(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		log.Printf("Purged %s\n", dir)
+	}
+
+	return nil
+}
+
+// cacheDirName makes a file or service name safe to use as a directory.
+// The cache directory of a service does not change when it is
+// reconfigured, so it can be found without the DB
+func cacheDirName(name string) string {
+	return nonVariableChars.ReplaceAllString(name, "_")
+}
+
+// CacheZoneTemplateStruct is for the proxy_cache_path of a service
+type CacheZoneTemplateStruct struct {
+	Name     string
+	Path     string
+	KeysSize string
+	MaxSize  string
+	Inactive string
+}
+
+// generateCacheZones writes one cache zone for every service
+// that has a location with caching
+func generateCacheZones(db *sql.DB, services models.ServiceSlice) error {
+	zones := map[string]CacheZoneTemplateStruct{}
+
+	for _, s := range services {
+		config := getFullConfig(s)
+		if strings.ToLower(config.Type) != "http" {
+			continue
+		}
+
+		for _, location := range config.AllLocations {
+			if location.Cache == nil {
+				continue
+			}
+
+			zone := CacheZoneTemplateStruct{
+				Name:     config.CacheZone,
+				Path:     config.CachePath,
+				KeysSize: "10m",
+				MaxSize:  "1g",
+				Inactive: "60m",
+			}
+
+			if config.Cache != nil {
+				if config.Cache.KeysSize != "" {
+					zone.KeysSize = config.Cache.KeysSize
+				}
+				if config.Cache.MaxSize != "" {
+					zone.MaxSize = config.Cache.MaxSize
+				}
+				if config.Cache.Inactive != "" {
+					zone.Inactive = config.Cache.Inactive
+				}
+			}
+
+			err := os.MkdirAll(zone.Path, 0755)
+			if err != nil {
+				return err
+			}
+
+			zones[zone.Name] = zone
+			break
+		}
+	}
+
+	var b bytes.Buffer
+	err := t.ExecuteTemplate(&b, "cacheZones", zones)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(cacheZonesPath, b.Bytes(), 0644)
+}
+
+// ValidStatuses are the arguments of the cache valid directives,
+// sorted so the generated config does not change between runs
+func (c Cache) ValidStatuses() []string {
+	var statuses []string
+	for status := range c.Valid {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	return statuses
+}
+
+var (
+	nginxTime     = regexp.MustCompile(`^([0-9]+(ms|s|m|h|d|w|M|y)?)+$`)
+	cacheStatuses = regexp.MustCompile(`^(any|[1-5][0-9][0-9])( [1-5][0-9][0-9])*$`)
+)
+
+var cacheUseStale = map[string]bool{
+	"error": true, "timeout": true, "invalid_header": true, "updating": true,
+	"http_500": true, "http_502": true, "http_503": true, "http_504": true,
+	"http_403": true, "http_404": true, "http_429": true, "off": true,
+}
+
+func validateCache(cache *Cache, protocol string) error {
+	if cache == nil {
+		return nil
+	}
+
+	switch protocol {
+	// Only proxy_cache_path zones are generated
+	case "http", "https":
+	default:
+		return fmt.Errorf("caching is not supported for %s locations", protocol)
+	}
+
+	for status, duration := range cache.Valid {
+		if !cacheStatuses.MatchString(status) {
+			return fmt.Errorf("invalid cache statuses %q", status)
+		}
+		if !nginxTime.MatchString(duration) {
+			return fmt.Errorf("invalid cache duration %q", duration)
+		}
+	}
+
+	for _, condition := range cache.UseStale {
+		if !cacheUseStale[condition] {
+			return fmt.Errorf("unknown cache use stale condition %q", condition)
+		}
+	}
+
+	for _, size := range []string{cache.KeysSize, cache.MaxSize} {
+		if size != "" && !nginxSize.MatchString(size) {
+			return fmt.Errorf("invalid cache size %q", size)
+		}
+	}
+
+	if cache.Inactive != "" && !nginxTime.MatchString(cache.Inactive) {
+		return fmt.Errorf("invalid cache inactive time %q", cache.Inactive)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+func clientAuthWithDefaults(clientAuth ClientAuth) *ClientAuth {
+	clientAuth.Verify = strings.ToLower(clientAuth.Verify)
+	if clientAuth.Verify == "" {
+		clientAuth.Verify = "required"
+	}
+
+	if clientAuth.SubjectHeader == "" {
+		clientAuth.SubjectHeader = "X-Client-Subject"
+	}
+
+	if clientAuth.VerifyHeader == "" {
+		clientAuth.VerifyHeader = "X-Client-Verify"
+	}
+
+	return &clientAuth
+}
+
+func validateClientAuth(config ConfigTemplateStruct) error {
+	clientAuth := config.ClientAuth
+	if clientAuth == nil {
+		return nil
+	}
+
+	// Requests over plain HTTP would skip the client certificate
+	if !config.Ssl || !config.HttpsOnly {
+		return fmt.Errorf("ClientAuth needs Ssl and HttpsOnly")
+	}
+
+	switch clientAuth.Verify {
+	case "required", "optional":
+	default:
+		return fmt.Errorf(
+			"invalid client certificate verification %q, use required or optional",
+			clientAuth.Verify,
+		)
+	}
+
+	for _, name := range []string{clientAuth.SubjectHeader, clientAuth.VerifyHeader} {
+		if !headerName.MatchString(name) {
+			return fmt.Errorf("invalid client certificate header %q", name)
+		}
+	}
+
+	if clientAuth.CaFile == "" {
+		return fmt.Errorf("a CaFile is needed to verify client certificates")
+	}
+
+	err := validateCaFile(clientAuth.CaFile)
+	if err != nil {
+		return err
+	}
+
+	if clientAuth.CrlFile != "" {
+		crl, err := ioutil.ReadFile(clientAuth.CrlFile)
+		if err != nil {
+			return err
+		}
+
+		if !hasPemBlock(crl, "X509 CRL") {
+			return fmt.Errorf("no revocation lists found in %q", clientAuth.CrlFile)
+		}
+	}
+
+	return nil
+}
+
+// validateCaFile checks that the file is a PEM bundle of certificates
+func validateCaFile(path string) error {
+	ca, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates found in %q", path)
+	}
+
+	return nil
+}
+
+// hasPemBlock is true if there is a PEM block of the type in the contents
+func hasPemBlock(contents []byte, blockType string) bool {
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			return false
+		}
+
+		if block.Type == blockType {
+			return true
+		}
+	}
+}
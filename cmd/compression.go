@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// UseBrotli is true if brotli is wanted and nginx has the module
+func (c Compression) UseBrotli() bool {
+	return c.Brotli && modules["brotli"]
+}
+
+var mimeType = regexp.MustCompile(`^(\*|[a-z0-9.+-]+/[a-zA-Z0-9.+*-]+)$`)
+
+func validateCompression(compression *Compression) error {
+	if compression == nil {
+		return nil
+	}
+
+	if compression.Level > 9 {
+		return fmt.Errorf("gzip level must be between 1 and 9, got %d", compression.Level)
+	}
+
+	if compression.BrotliLevel > 11 {
+		return fmt.Errorf("brotli level must be between 1 and 11, got %d", compression.BrotliLevel)
+	}
+
+	for _, t := range compression.Types {
+		if !mimeType.MatchString(t) {
+			return fmt.Errorf("invalid MIME type %q", t)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var defaultCorsMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// AllowsAnyOrigin is true if "*" is one of the allowed origins
+func (c Cors) AllowsAnyOrigin() bool {
+	for _, origin := range c.AllowOrigins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// OriginRegexes are the map keys matching the allowed origins.
+// A "*" in an origin matches any subdomain
+func (c Cors) OriginRegexes() []string {
+	var regexes []string
+
+	for _, origin := range c.AllowOrigins {
+		if origin == "*" {
+			continue
+		}
+
+		pattern := regexp.QuoteMeta(strings.ToLower(origin))
+		pattern = strings.Replace(pattern, `\*`, `[a-z0-9.-]+`, -1)
+		regexes = append(regexes, "~*^"+pattern+"$")
+	}
+
+	return regexes
+}
+
+func validateCors(cors *Cors) error {
+	if cors == nil {
+		return nil
+	}
+
+	if len(cors.AllowOrigins) == 0 {
+		return fmt.Errorf("cors needs at least one allowed origin")
+	}
+
+	// Echoing every origin with credentials would let any site
+	// make requests with the cookies of the user
+	if cors.AllowsAnyOrigin() && cors.AllowCredentials {
+		return fmt.Errorf("cors can not allow credentials for every origin")
+	}
+
+	for _, origin := range cors.AllowOrigins {
+		if origin != "*" && !strings.Contains(origin, "://") {
+			return fmt.Errorf("cors origin %q must include the scheme", origin)
+		}
+	}
+
+	for _, header := range append(cors.AllowHeaders, cors.ExposeHeaders...) {
+		if !headerName.MatchString(header) {
+			return fmt.Errorf("invalid header name %q", header)
+		}
+	}
+
+	return nil
+}
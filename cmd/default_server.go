@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/stephenafamo/warden/models"
+	"github.com/volatiletech/sqlboiler/queries/qm"
+)
+
+const (
+	defaultServerConfigPath = "/etc/nginx/conf.d/http/00-default.conf"
+	defaultCertPath         = "/etc/nginx/ssl/default.crt"
+	defaultKeyPath          = "/etc/nginx/ssl/default.key"
+)
+
+// generateDefaultCertificate creates the self-signed certificate used for
+// TLS connections to unknown hosts
+func generateDefaultCertificate() error {
+	if _, err := os.Stat(defaultCertPath); err == nil {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(defaultCertPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(
+		"openssl",
+		"req",
+		"-x509",
+		"-nodes",
+		"-newkey",
+		"rsa:2048",
+		"-days",
+		"3650",
+		"-subj",
+		"/CN=warden",
+		"-keyout",
+		defaultKeyPath,
+		"-out",
+		defaultCertPath,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf(
+			"Can't generate default certificate: %s: %s",
+			err,
+			output,
+		)
+	}
+
+	return nil
+}
+
+// defaultServerConflicts finds the services to configure that want to be
+// the Default on an address a configured service, or another of the services,
+// is already the Default on. The errors are keyed by service ID
+func defaultServerConflicts(db *sql.DB, services models.ServiceSlice) (map[int64]error, error) {
+	configured, err := models.Services(
+		qm.Load(models.ServiceRels.File),
+		models.ServiceWhere.FileID.IsNotNull(),
+		models.ServiceWhere.State.NEQ(stateNotConfigured),
+	).All(context.Background(), db)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := map[string]*models.Service{}
+	conflicts := map[int64]error{}
+
+	for _, s := range append(configured, services...) {
+		addresses := defaultServerAddresses(getFullConfig(s))
+
+		for _, address := range addresses {
+			owner, ok := owners[address]
+			if !ok {
+				continue
+			}
+
+			conflicts[s.ID] = fmt.Errorf(
+				"service %q in file %q is already the Default on %s",
+				owner.Name,
+				owner.R.File.Path,
+				address,
+			)
+			break
+		}
+
+		if conflicts[s.ID] != nil {
+			continue
+		}
+
+		for _, address := range addresses {
+			owners[address] = s
+		}
+	}
+
+	return conflicts, nil
+}
+
+// defaultServerAddresses are the addresses the service
+// is the default_server on
+func defaultServerAddresses(config ConfigTemplateStruct) []string {
+	if !config.Default || strings.ToLower(config.Type) != "http" {
+		return nil
+	}
+
+	var addresses []string
+	for _, listens := range [][]string{config.HttpListen, config.HttpsListen} {
+		for _, directive := range listens {
+			addresses = append(addresses, strings.Fields(directive)[0])
+		}
+	}
+
+	return addresses
+}
+
+// generateDefaultServerConfig writes the catch-all server.
+// It is not the default_server on any address a service with
+// Default = true is already using
+func generateDefaultServerConfig(db *sql.DB, services models.ServiceSlice) error {
+	taken := map[string]bool{}
+
+	for _, s := range services {
+		config := getFullConfig(s)
+		if !config.Default || strings.ToLower(config.Type) != "http" {
+			continue
+		}
+
+		for _, directive := range config.HttpListen {
+			taken[strings.Fields(directive)[0]] = true
+		}
+
+		if config.Ssl && s.State != stateToConfigureHttps {
+			for _, directive := range config.HttpsListen {
+				taken[strings.Fields(directive)[0]] = true
+			}
+		}
+	}
+
+	httpListens := []Listen{{Port: defaultHttpPort}}
+	httpsListens := []Listen{{Port: defaultHttpsPort, Ssl: true}}
+	setProxyProtocol(httpListens, httpsListens)
+
+	defaultServer := DefaultServerTemplateStruct{
+		HttpListen:  listenDirectives(httpListens),
+		HttpsListen: listenDirectives(httpsListens),
+		RealIpFrom:  proxyProtocolRealIpFrom(httpsListens, sniRouterSource("")),
+		CertPath:    defaultCertPath,
+		KeyPath:     defaultKeyPath,
+	}
+
+	for _, listens := range [][]string{defaultServer.HttpListen, defaultServer.HttpsListen} {
+		for i, directive := range listens {
+			if !taken[strings.Fields(directive)[0]] {
+				listens[i] += " default_server"
+			}
+		}
+	}
+
+	if getSettings().DefaultPage != "" {
+		defaultServer.PageDir = filepath.Dir(getSettings().DefaultPage)
+		defaultServer.Page = filepath.Base(getSettings().DefaultPage)
+	}
+
+	var b bytes.Buffer
+	err := t.ExecuteTemplate(&b, "defaultServer", defaultServer)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(defaultServerConfigPath, b.Bytes(), 0644)
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// statuses add_header uses without always, for more_set_headers
+const successStatuses = "200 201 204 206 301 302 303 304 307 308"
+
+// headersSetByWarden are always sent to the upstream, so request
+// rules can not change them
+var headersSetByWarden = map[string]bool{
+	"host":              true,
+	"x-real-ip":         true,
+	"x-forwarded-for":   true,
+	"x-forwarded-proto": true,
+}
+
+// RequestHeaderDirectives are the directives for the request rules
+func (l LocationTemplateStruct) RequestHeaderDirectives() []string {
+	var directives []string
+
+	for _, rule := range l.HeaderRules.Request {
+		value := quote(rule.Value)
+		if strings.ToLower(rule.Action) == "remove" {
+			value = `""`
+		}
+		directives = append(directives, l.SetHeader(rule.Name, value))
+	}
+
+	return directives
+}
+
+// ResponseHeaderDirectives are the directives for the response rules.
+// headers-more is used if nginx has it, so set and remove also work
+// for headers added by nginx
+func (l LocationTemplateStruct) ResponseHeaderDirectives() []string {
+	var directives []string
+	headersMore := modules["headers-more"]
+
+	for _, rule := range l.HeaderRules.Response {
+		always := ""
+		if rule.Always {
+			always = " always"
+		}
+
+		switch strings.ToLower(rule.Action) {
+		case "set":
+			if headersMore {
+				statuses := ""
+				if !rule.Always {
+					statuses = "-s " + quote(successStatuses) + " "
+				}
+				directives = append(directives, fmt.Sprintf(
+					"more_set_headers %s%s;",
+					statuses,
+					quote(rule.Name+": "+rule.Value),
+				))
+				continue
+			}
+
+			directives = append(directives,
+				fmt.Sprintf("%s_hide_header %s;", l.DirectivePrefix(), rule.Name),
+				fmt.Sprintf("add_header %s %s%s;", rule.Name, quote(rule.Value), always),
+			)
+		case "add":
+			directives = append(directives, fmt.Sprintf(
+				"add_header %s %s%s;", rule.Name, quote(rule.Value), always,
+			))
+		case "remove":
+			if headersMore {
+				directives = append(directives, fmt.Sprintf(
+					"more_clear_headers %s;", quote(rule.Name),
+				))
+				continue
+			}
+
+			directives = append(directives, fmt.Sprintf(
+				"%s_hide_header %s;", l.DirectivePrefix(), rule.Name,
+			))
+		}
+	}
+
+	return directives
+}
+
+// mergeHeaderRules puts the rules of a location after the ones of its service
+func mergeHeaderRules(service, location *HeaderRules) *HeaderRules {
+	if service == nil {
+		return location
+	}
+
+	if location == nil {
+		return service
+	}
+
+	var merged HeaderRules
+	merged.Request = append(merged.Request, service.Request...)
+	merged.Request = append(merged.Request, location.Request...)
+	merged.Response = append(merged.Response, service.Response...)
+	merged.Response = append(merged.Response, location.Response...)
+
+	return &merged
+}
+
+func validateHeaderRules(rules *HeaderRules) error {
+	if rules == nil {
+		return nil
+	}
+
+	for _, rule := range rules.Request {
+		if !headerName.MatchString(rule.Name) {
+			return fmt.Errorf("invalid header name %q", rule.Name)
+		}
+
+		if headersSetByWarden[strings.ToLower(rule.Name)] {
+			return fmt.Errorf("the %s request header is set by warden", rule.Name)
+		}
+
+		switch strings.ToLower(rule.Action) {
+		case "set", "remove":
+		default:
+			return fmt.Errorf(
+				"unknown action %q for the %s request header, use set or remove",
+				rule.Action,
+				rule.Name,
+			)
+		}
+	}
+
+	for _, rule := range rules.Response {
+		if !headerName.MatchString(rule.Name) {
+			return fmt.Errorf("invalid header name %q", rule.Name)
+		}
+
+		switch strings.ToLower(rule.Action) {
+		case "set", "add", "remove":
+		default:
+			return fmt.Errorf(
+				"unknown action %q for the %s response header, use set, add or remove",
+				rule.Action,
+				rule.Name,
+			)
+		}
+	}
+
+	return nil
+}
@@ -20,7 +20,7 @@ func getLetsEncryptCertificate(config *ConfigTemplateStruct) (string, string, er
 		"certonly",
 		"--agree-tos",
 		"--email",
-		settings.Email,
+		getSettings().Email,
 		"-q",
 		"--cert-name",
 		config.Domains[0],
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultHttpPort  = 80
+	defaultHttpsPort = 4343 // the SNI router on 443 proxies to this port
+)
+
+// setListenDirectives fills in the arguments of the listen directives
+// of every server block the service might need
+func setListenDirectives(config *ConfigTemplateStruct) {
+	var httpListens, httpsListens []Listen
+
+	for _, listen := range config.Listen {
+		if listen.Ssl {
+			// gRPC needs HTTP/2. On plain text listeners it has to be
+			// turned on explicitly, see validateGrpcListen
+			listen.Http2 = listen.Http2 || config.Grpc
+
+			if listen.Port == 0 {
+				listen.Port = defaultHttpsPort
+			}
+			httpsListens = append(httpsListens, listen)
+			continue
+		}
+
+		if listen.Port == 0 {
+			listen.Port = defaultHttpPort
+		}
+		httpListens = append(httpListens, listen)
+	}
+
+	if len(httpListens) == 0 {
+		httpListens = []Listen{{Port: defaultHttpPort}}
+	}
+
+	if len(httpsListens) == 0 {
+		httpsListens = []Listen{{Port: defaultHttpsPort, Ssl: true, Http2: true}}
+	}
+
+	setProxyProtocol(httpListens, httpsListens)
+
+	config.HttpListen = listenDirectives(httpListens)
+	config.HttpsListen = listenDirectives(httpsListens)
+	config.SniUpstream = sniUpstream(httpsListens[0])
+	config.HttpRealIpFrom = proxyProtocolRealIpFrom(httpListens, "")
+	config.HttpsRealIpFrom = proxyProtocolRealIpFrom(
+		httpsListens,
+		sniRouterSource(config.SniUpstream),
+	)
+
+	if config.Default {
+		for i := range config.HttpListen {
+			config.HttpListen[i] += " default_server"
+		}
+		for i := range config.HttpsListen {
+			config.HttpsListen[i] += " default_server"
+		}
+	}
+
+	streamListen := Listen{Port: config.Port}
+	if config.ProxyProtocol != nil {
+		streamListen.ProxyProtocol = config.ProxyProtocol.Accept
+	}
+
+	streamFlag := ""
+	if strings.ToLower(config.Type) == "udp" {
+		streamFlag = " udp"
+	}
+
+	for _, directive := range listenDirectives([]Listen{streamListen}) {
+		config.StreamListen = append(config.StreamListen, directive+streamFlag)
+	}
+}
+
+func listenDirectives(listens []Listen) []string {
+	var directives []string
+
+	for _, listen := range listens {
+		flags := ""
+		if listen.Ssl {
+			flags += " ssl"
+		}
+		if listen.Http2 {
+			flags += " http2"
+		}
+		if listen.ProxyProtocol {
+			flags += " proxy_protocol"
+		}
+
+		port := strconv.FormatUint(uint64(listen.Port), 10)
+
+		if listen.Address != "" {
+			directives = append(
+				directives,
+				net.JoinHostPort(listen.Address, port)+flags,
+			)
+			continue
+		}
+
+		directives = append(directives, port+flags)
+		if !listen.DisableIpv6 && !getSettings().DisableIpv6 {
+			directives = append(directives, "[::]:"+port+flags)
+		}
+	}
+
+	return directives
+}
+
+// sniUpstream is where the SNI router on port 443 should send requests
+// for the domains of the service. It is empty when the default is fine
+func sniUpstream(listen Listen) string {
+	if listen.Port == defaultHttpsPort && listen.Address == "" {
+		return ""
+	}
+
+	host := listen.Address
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(listen.Port), 10))
+}
+
+// validateGrpcListen checks that gRPC locations served over plain text
+// have their own HTTP/2 listeners. nginx turns on HTTP/2 for every
+// server on the address, which would break HTTP/1.1 on the shared port 80
+func validateGrpcListen(config ConfigTemplateStruct) error {
+	if !config.Grpc || (config.Ssl && config.HttpsOnly) {
+		return nil
+	}
+
+	var httpListens []Listen
+	for _, listen := range config.Listen {
+		if !listen.Ssl {
+			httpListens = append(httpListens, listen)
+		}
+	}
+
+	if len(httpListens) == 0 {
+		return fmt.Errorf(
+			"gRPC over plain text needs its own port in Listen, or use Ssl and HttpsOnly",
+		)
+	}
+
+	for _, listen := range httpListens {
+		if listen.Port == 0 || listen.Port == defaultHttpPort {
+			return fmt.Errorf("gRPC can not be served over plain text on port 80")
+		}
+
+		if !listen.Http2 {
+			return fmt.Errorf(
+				"plain text listener on port %d needs Http2 for gRPC",
+				listen.Port,
+			)
+		}
+	}
+
+	return nil
+}
+
+func validateListen(listens []Listen) error {
+	for _, listen := range listens {
+		if listen.Port == 443 {
+			return fmt.Errorf(
+				"cannot listen on port 443, it is used to route by SNI",
+			)
+		}
+
+		if listen.Address != "" && net.ParseIP(listen.Address) == nil {
+			return fmt.Errorf("invalid listen address %q", listen.Address)
+		}
+	}
+
+	return nil
+}
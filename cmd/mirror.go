@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/stephenafamo/warden/models"
+)
+
+// unreachableMirrors are the mirror upstreams left out of the base
+// config of their service. The https config uses the upstream block
+// of the base config, so it leaves them out too
+var unreachableMirrors = map[string]bool{}
+var unreachableMirrorsMu sync.Mutex
+
+// pingMirrors leaves out the mirrors that cannot be reached, since
+// nginx rejects an upstream host it cannot resolve and a mirror is not
+// worth failing the service for
+func pingMirrors(config *ConfigTemplateStruct, s *models.Service) {
+	unreachableMirrorsMu.Lock()
+	defer unreachableMirrorsMu.Unlock()
+
+	pinged := map[string]bool{}
+	for _, location := range config.AllLocations {
+		if location.Mirror == nil || pinged[location.MirrorUpstream] {
+			continue
+		}
+		pinged[location.MirrorUpstream] = true
+
+		ok, unreachable := pingServers(location.Mirror.Upstream)
+		unreachableMirrors[location.MirrorUpstream] = !ok
+		if !ok {
+			log.Printf(
+				"Cannot reach mirror %q for service %q in file %q, leaving it out\n",
+				unreachable,
+				s.Name,
+				s.R.File.Path,
+			)
+		}
+	}
+
+	removeMirrors(config, func(upstream string) bool {
+		return unreachableMirrors[upstream]
+	})
+}
+
+// removeUnreachableMirrors leaves out the mirrors that were left out
+// of the base config by pingMirrors
+func removeUnreachableMirrors(config *ConfigTemplateStruct) {
+	unreachableMirrorsMu.Lock()
+	defer unreachableMirrorsMu.Unlock()
+
+	removeMirrors(config, func(upstream string) bool {
+		return unreachableMirrors[upstream]
+	})
+}
+
+// removeMirrorsNotIn leaves out the mirrors that do not have an
+// upstream block in a rendered config, for when pingMirrors ran in
+// another process
+func removeMirrorsNotIn(config *ConfigTemplateStruct, rendered []byte) {
+	removeMirrors(config, func(upstream string) bool {
+		return !bytes.Contains(rendered, []byte("upstream "+upstream+" {"))
+	})
+}
+
+func removeMirrors(config *ConfigTemplateStruct, remove func(upstream string) bool) {
+	for i, location := range config.AllLocations {
+		if location.Mirror != nil && remove(location.MirrorUpstream) {
+			config.AllLocations[i].Mirror = nil
+		}
+	}
+}
+
+// MirrorUpstreams are the upstream blocks of the mirrors used by
+// the locations of the service
+func (c ConfigTemplateStruct) MirrorUpstreams() []UpstreamTemplateStruct {
+	var blocks []UpstreamTemplateStruct
+	seen := map[string]bool{}
+
+	for _, location := range c.AllLocations {
+		if location.Mirror == nil || seen[location.MirrorUpstream] {
+			continue
+		}
+		seen[location.MirrorUpstream] = true
+
+		blocks = append(blocks, UpstreamTemplateStruct{
+			Unique:          location.MirrorUpstream,
+			Upstream:        location.Mirror.Upstream,
+			UpstreamOptions: location.Mirror.UpstreamOptions,
+		})
+	}
+
+	return blocks
+}
+
+// SamplePercent is the percentage of requests to mirror for
+// split_clients. Empty if all requests are mirrored
+func (m Mirror) SamplePercent() string {
+	if m.Percent == 0 || m.Percent >= 100 {
+		return ""
+	}
+
+	return strconv.FormatFloat(float64(m.Percent), 'f', -1, 64) + "%"
+}
+
+func validateMirror(location LocationTemplateStruct) error {
+	mirror := location.Mirror
+	if mirror == nil {
+		return nil
+	}
+
+	if location.Protocol != "http" && location.Protocol != "https" {
+		return fmt.Errorf("only http and https locations can be mirrored, %q is %s", location.Match, location.Protocol)
+	}
+
+	if len(mirror.Upstream) == 0 {
+		return fmt.Errorf("the mirror of location %q has no upstream servers", location.Match)
+	}
+
+	if mirror.Percent < 0 || mirror.Percent > 100 {
+		return fmt.Errorf("the mirror percentage must be between 0 and 100")
+	}
+
+	if !nginxTime.MatchString(mirror.Timeout) {
+		return fmt.Errorf("invalid mirror timeout %q", mirror.Timeout)
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const nginxModulesDir = "/etc/nginx/modules"
+
+// nginxModule is an optional module that warden uses if nginx has it
+type nginxModule struct {
+	ConfigureArg string   // in the output of nginx -V when compiled in
+	Files        []string // in the modules dir when it is a dynamic module
+}
+
+var optionalModules = map[string]nginxModule{
+	"brotli": {
+		ConfigureArg: "brotli",
+		Files: []string{
+			"ngx_http_brotli_filter_module.so",
+			"ngx_http_brotli_static_module.so",
+		},
+	},
+	"headers-more": {
+		ConfigureArg: "headers-more",
+		Files: []string{
+			"ngx_http_headers_more_filter_module.so",
+		},
+	},
+}
+
+// modules are the optional modules that were found. Set by detectModules
+var modules = map[string]bool{}
+
+// dynamicModules are loaded in nginx.conf
+var dynamicModules []string
+
+// detectModules checks which optional modules nginx was compiled
+// with, or has as dynamic modules
+func detectModules() error {
+	output, err := exec.Command("nginx", "-V").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Can't get NGINX modules: %s: %s", err, output)
+	}
+
+	for name, module := range optionalModules {
+		if strings.Contains(string(output), module.ConfigureArg) {
+			modules[name] = true
+			continue
+		}
+
+		var files []string
+		for _, file := range module.Files {
+			path := filepath.Join(nginxModulesDir, file)
+			if _, err := os.Stat(path); err == nil {
+				files = append(files, path)
+			}
+		}
+
+		if len(files) == len(module.Files) {
+			modules[name] = true
+			dynamicModules = append(dynamicModules, files...)
+		}
+	}
+
+	for name := range modules {
+		log.Printf("Found NGINX module: %s\n", name)
+	}
+
+	return nil
+}
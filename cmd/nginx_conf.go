@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// NginxConfTemplateStruct is for the nginx.conf template
+type NginxConfTemplateStruct struct {
+	Settings
+	LoadModules []string // paths of the dynamic modules to load
+}
+
+// generateNginxConf writes nginx.conf from the settings.
+// It reports if the file was changed
+func generateNginxConf() (bool, error) {
+	var b bytes.Buffer
+	current := getSettings()
+
+	err := t.ExecuteTemplate(&b, "nginxConf", NginxConfTemplateStruct{
+		Settings:    current,
+		LoadModules: dynamicModules,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	oldContents, err := ioutil.ReadFile(current.NginxConfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if bytes.Equal(oldContents, b.Bytes()) {
+		return false, nil
+	}
+
+	err = ioutil.WriteFile(current.NginxConfPath, b.Bytes(), 0644)
+	if err != nil {
+		return false, err
+	}
+
+	err = testNginxConfig()
+	if err != nil {
+		// Put back the old config so a reload does not break nginx
+		if oldContents != nil {
+			ioutil.WriteFile(current.NginxConfPath, oldContents, 0644)
+		}
+		return false, err
+	}
+
+	log.Printf("GENERATED: %s\n", current.NginxConfPath)
+	return true, nil
+}
+
+func testNginxConfig() error {
+	cmd := exec.Command("nginx", "-t", "-q", "-c", getSettings().NginxConfPath)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf(
+			"Invalid NGINX config: %s: %s",
+			err,
+			output,
+		)
+	}
+	return nil
+}
+
+// watchConfigFile regenerates nginx.conf and reloads nginx
+// when the warden config file is modified.
+// All the services are configured again if settings they use changed
+func watchConfigFile(db *sql.DB) {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		newSettings := loadSettings()
+
+		err := validateSettings(newSettings)
+		if err != nil {
+			log.Printf("Invalid settings in %q: %s\n", e.Name, err)
+			return
+		}
+
+		oldSettings := getSettings()
+		setSettings(newSettings)
+
+		changed, err := generateNginxConf()
+		if err != nil {
+			setSettings(oldSettings)
+			log.Println(err)
+			return
+		}
+
+		if serviceSettingsChanged(oldSettings, newSettings) {
+			err = regenerateAllServices(db)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+
+		if changed {
+			err = reloadNginx()
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	})
+
+	viper.WatchConfig()
+}
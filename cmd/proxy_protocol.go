@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// setProxyProtocol turns on the PROXY protocol for the listeners that
+// get it from the load balancer in front of warden, or from the SNI router.
+// httpsListens[0] is the listener the SNI router sends connections to.
+// It is only turned on for the internal port, since clients may connect
+// to the other listeners directly. See validateProxyProtocol
+func setProxyProtocol(httpListens, httpsListens []Listen) {
+	if !getSettings().ProxyProtocol {
+		return
+	}
+
+	for i, listen := range httpListens {
+		if listen.Port == defaultHttpPort && listen.Address == "" {
+			httpListens[i].ProxyProtocol = true
+		}
+	}
+
+	if len(httpsListens) > 0 && sniUpstream(httpsListens[0]) == "" {
+		httpsListens[0].ProxyProtocol = true
+	}
+}
+
+// proxyProtocolRealIpFrom lists the addresses trusted to send
+// the PROXY protocol to the listeners. It is empty if none of the
+// listeners accept it. sniSource is the address the SNI router
+// connects from, empty if the listeners do not get its connections
+func proxyProtocolRealIpFrom(listens []Listen, sniSource string) []string {
+	accepts := false
+	for _, listen := range listens {
+		accepts = accepts || listen.ProxyProtocol
+	}
+
+	if !accepts {
+		return nil
+	}
+
+	from := append([]string{}, getSettings().RealIpFrom...)
+	if sniSource == "" {
+		return from
+	}
+
+	for _, address := range from {
+		if address == sniSource {
+			return from
+		}
+	}
+
+	return append(from, sniSource)
+}
+
+// sniRouterSource is the address the SNI router on port 443 connects
+// from when passing a connection to sniUpstream.
+// It is empty if the router does not send the PROXY protocol
+func sniRouterSource(sniUpstream string) string {
+	if !getSettings().ProxyProtocol {
+		return ""
+	}
+
+	if sniUpstream == "" {
+		return "127.0.0.1"
+	}
+
+	host, _, _ := net.SplitHostPort(sniUpstream)
+	return host
+}
+
+func validateProxyProtocol(config ConfigTemplateStruct) error {
+	accepts := false
+	for _, listen := range config.Listen {
+		accepts = accepts || listen.ProxyProtocol
+	}
+
+	if pp := config.ProxyProtocol; pp != nil {
+		switch strings.ToLower(config.Type) {
+		case "tcp", "stream":
+		default:
+			return fmt.Errorf(
+				"the PROXY protocol is not supported for %s services",
+				config.Type,
+			)
+		}
+
+		accepts = accepts || pp.Accept
+	}
+
+	// The SNI router sends the PROXY protocol to every listener
+	if getSettings().ProxyProtocol && config.Ssl && config.SniUpstream != "" {
+		for _, listen := range config.Listen {
+			if !listen.Ssl {
+				continue
+			}
+
+			if !listen.ProxyProtocol {
+				return fmt.Errorf(
+					"the SNI router sends the PROXY protocol to %s, set ProxyProtocol on its Listen",
+					config.SniUpstream,
+				)
+			}
+			break
+		}
+	}
+
+	if accepts && len(getSettings().RealIpFrom) == 0 {
+		return fmt.Errorf(
+			"REAL_IP_FROM is needed to trust the addresses sending the PROXY protocol",
+		)
+	}
+
+	return nil
+}
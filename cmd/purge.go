@@ -11,7 +11,7 @@ import (
 var lastPurge time.Time
 
 func PurgeConfigFiles(db *sql.DB) error {
-	duration, err := time.ParseDuration(settings.ReloadDuration)
+	duration, err := time.ParseDuration(getSettings().ReloadDuration)
 	if err != nil {
 		return err
 	}
@@ -20,6 +20,12 @@ func PurgeConfigFiles(db *sql.DB) error {
 		return nil
 	}
 
-	_, err = models.Files().DeleteAll(context.Background(), db)
+	return regenerateAllServices(db)
+}
+
+// regenerateAllServices deletes the files from the DB, so the services
+// in them are configured again the next time the config directory is walked
+func regenerateAllServices(db *sql.DB) error {
+	_, err := models.Files().DeleteAll(context.Background(), db)
 	return err
 }
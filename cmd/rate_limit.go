@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"strings"
+
+	"github.com/stephenafamo/warden/models"
+)
+
+const rateLimitZonesPath = "/etc/nginx/conf.d/global/rate_limits.conf"
+
+// rateLimitZone is the name of the shared memory zone of a limit.
+// Locations with their own RateLimit have their own zone, and the
+// locations using the RateLimit of the service share its zone
+func rateLimitZone(unique string) string {
+	return "warden_rate_" + nginxVariableName(unique)
+}
+
+// generateRateLimitZones writes the limit_req_zone of every
+// rate limit used by the services
+func generateRateLimitZones(db *sql.DB, services models.ServiceSlice) error {
+	zones := map[string]RateLimit{}
+
+	for _, s := range services {
+		config := getFullConfig(s)
+		if strings.ToLower(config.Type) != "http" {
+			continue
+		}
+
+		for _, location := range config.AllLocations {
+			if location.RateLimit != nil {
+				zones[location.RateLimitZone] = *location.RateLimit
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	err := t.ExecuteTemplate(&b, "rateLimitZones", zones)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(rateLimitZonesPath, b.Bytes(), 0644)
+}
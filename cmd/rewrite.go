@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PrefixRewrite is the regex and replacement of the rewrite that
+// strips and adds the path prefixes. Empty if neither is set
+func (l LocationTemplateStruct) PrefixRewrite() []string {
+	if l.StripPrefix == "" && l.AddPrefix == "" {
+		return nil
+	}
+
+	strip := regexp.QuoteMeta(strings.TrimSuffix(l.StripPrefix, "/"))
+	add := strings.TrimSuffix(l.AddPrefix, "/")
+
+	return []string{"^" + strip + "(?:/(.*))?$", add + "/$1"}
+}
+
+func validateRewrites(location LocationTemplateStruct) error {
+	for _, prefix := range []string{location.StripPrefix, location.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("path prefix %q must start with /", prefix)
+		}
+	}
+
+	if (location.StripPrefix != "" || location.AddPrefix != "" || len(location.Rewrites) > 0) &&
+		location.IsGrpc() {
+		return fmt.Errorf("paths of grpc location %q can not be rewritten", location.Match)
+	}
+
+	for _, rewrite := range location.Rewrites {
+		_, err := regexp.Compile(rewrite.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite regex %q: %s", rewrite.Regex, err)
+		}
+
+		switch rewrite.Flag {
+		case "", "last", "break", "redirect", "permanent":
+		default:
+			return fmt.Errorf("unknown rewrite flag %q", rewrite.Flag)
+		}
+	}
+
+	return nil
+}
@@ -35,11 +35,18 @@ func init() {
 
 func initConfig() {
 	viper.AutomaticEnv() // read in environment variables that match
-	settings.DbPath = "./db"
-	settings.Email = viper.GetString("EMAIL")
-	settings.ConfigDir = viper.GetString("CONFIG_DIR")
-	settings.ReloadDuration = viper.GetString("CONFIG_RELOAD_TIME")
-	settings.PurgeDuration = viper.GetString("CONFIG_VALIDITY")
+	setDefaultSettings()
+
+	configFile := viper.GetString("WARDEN_CONFIG")
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+		err := viper.ReadInConfig()
+		if err != nil {
+			log.Fatalf("Can't read config file %q: %s", configFile, err)
+		}
+	}
+
+	setSettings(loadSettings())
 }
 
 func rootFunc(cmd *cobra.Command, args []string) error {
@@ -49,7 +56,7 @@ func rootFunc(cmd *cobra.Command, args []string) error {
 	c := exec.Command(
 		"/bin/sh", 
 		"-c", 
-		"rm -rf "+settings.DbPath+" /etc/nginx/conf.d/http/* /etc/nginx/conf.d/streams/*",
+		"rm -rf "+getSettings().DbPath+" /etc/nginx/conf.d/http/* /etc/nginx/conf.d/streams/* /etc/nginx/conf.d/pages/* /etc/nginx/conf.d/sni/* /etc/nginx/conf.d/global/* /etc/nginx/conf.d/htpasswd/*",
 	)
 
 	output, err := c.CombinedOutput()
@@ -62,7 +69,7 @@ func rootFunc(cmd *cobra.Command, args []string) error {
 	}
 
 	log.Println("Connecting to DB...")
-	db, err := sql.Open("sqlite3", settings.DbPath+"?_fk=1")
+	db, err := sql.Open("sqlite3", getSettings().DbPath+"?_fk=1")
 	if err != nil {
 		return err
 	}
@@ -73,6 +80,39 @@ func rootFunc(cmd *cobra.Command, args []string) error {
 	}
 	defer db.Close()
 
+	err = validateSettings(getSettings())
+	if err != nil {
+		return err
+	}
+
+	err = detectModules()
+	if err != nil {
+		return err
+	}
+
+	_, err = generateNginxConf()
+	if err != nil {
+		return err
+	}
+	watchConfigFile(db)
+
+	if getSettings().DefaultPage != "" {
+		_, err = os.Stat(getSettings().DefaultPage)
+		if err != nil {
+			return fmt.Errorf("Can't use default page: %s", err)
+		}
+	}
+
+	err = generateDefaultCertificate()
+	if err != nil {
+		return err
+	}
+
+	err = generateSharedConfig(db)
+	if err != nil {
+		return err
+	}
+
 	err = startConfigDirectoryWatcher(db)
 	if err != nil {
 		return err
@@ -88,6 +128,11 @@ func rootFunc(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	err = startBlueGreenHealthChecker(db)
+	if err != nil {
+		return err
+	}
+
 	err = startNginx()
 	if err != nil {
 		return err
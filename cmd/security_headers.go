@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const defaultHstsMaxAge = 15768000
+
+// Header is a header name and its value
+type Header struct {
+	Name  string
+	Value string
+}
+
+var securityHeaderPresets = map[string]SecurityHeaders{
+	"basic": {
+		FrameOptions:       "SAMEORIGIN",
+		ContentTypeOptions: "nosniff",
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+	},
+	"strict": {
+		ContentSecurityPolicy: "default-src 'self'; frame-ancestors 'none'; base-uri 'self'; form-action 'self'",
+		FrameOptions:          "DENY",
+		ContentTypeOptions:    "nosniff",
+		ReferrerPolicy:        "no-referrer",
+		PermissionsPolicy:     "camera=(), microphone=(), geolocation=(), payment=()",
+	},
+}
+
+// Headers are the security headers to add to responses, apart from HSTS.
+// Values set on the block override the ones from the preset, and "off"
+// removes a header
+func (s SecurityHeaders) Headers() []Header {
+	preset := securityHeaderPresets[strings.ToLower(s.Preset)]
+
+	var headers []Header
+	add := func(name, value, presetValue string) {
+		if value == "" {
+			value = presetValue
+		}
+		if value == "" || strings.ToLower(value) == "off" {
+			return
+		}
+		headers = append(headers, Header{Name: name, Value: value})
+	}
+
+	add("Content-Security-Policy", s.ContentSecurityPolicy, preset.ContentSecurityPolicy)
+	add("X-Frame-Options", s.FrameOptions, preset.FrameOptions)
+	add("X-Content-Type-Options", s.ContentTypeOptions, preset.ContentTypeOptions)
+	add("Referrer-Policy", s.ReferrerPolicy, preset.ReferrerPolicy)
+	add("Permissions-Policy", s.PermissionsPolicy, preset.PermissionsPolicy)
+
+	return headers
+}
+
+// HstsValue is the value of the Strict-Transport-Security header.
+// It is empty if HSTS is disabled
+func (s SecurityHeaders) HstsValue() string {
+	if s.Hsts == nil {
+		return "max-age=" + strconv.Itoa(defaultHstsMaxAge)
+	}
+
+	if s.Hsts.Disable {
+		return ""
+	}
+
+	maxAge := s.Hsts.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultHstsMaxAge
+	}
+
+	value := "max-age=" + strconv.FormatUint(uint64(maxAge), 10)
+	if s.Hsts.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if s.Hsts.Preload {
+		value += "; preload"
+	}
+
+	return value
+}
+
+// HstsValue is the HSTS header of a location of an HTTPS service.
+// It is added in every location, since nginx drops the add_header of
+// the server in locations with their own, e.g. from Cors or Sticky
+func (l LocationTemplateStruct) HstsValue() string {
+	if !l.Ssl {
+		return ""
+	}
+
+	if l.SecurityHeaders == nil {
+		return SecurityHeaders{}.HstsValue()
+	}
+
+	return l.SecurityHeaders.HstsValue()
+}
+
+// ServerHstsValue is the HSTS header of the https server.
+// It is the default one if the service has no SecurityHeaders
+func (c ConfigTemplateStruct) ServerHstsValue() string {
+	if c.SecurityHeaders == nil {
+		return SecurityHeaders{}.HstsValue()
+	}
+
+	return c.SecurityHeaders.HstsValue()
+}
+
+func validateSecurityHeaders(headers *SecurityHeaders) error {
+	if headers == nil {
+		return nil
+	}
+
+	if headers.Preset != "" {
+		if _, ok := securityHeaderPresets[strings.ToLower(headers.Preset)]; !ok {
+			return fmt.Errorf("unknown security header preset %q", headers.Preset)
+		}
+	}
+
+	hsts := headers.Hsts
+	if hsts != nil && hsts.Preload && !hsts.Disable {
+		if !hsts.IncludeSubDomains || hsts.MaxAge < 31536000 {
+			return fmt.Errorf("hsts preload needs IncludeSubDomains and a MaxAge of at least 31536000")
+		}
+	}
+
+	return nil
+}
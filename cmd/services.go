@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/stephenafamo/warden/models"
+	"github.com/volatiletech/sqlboiler/queries/qm"
+)
+
+var servicesCmd = &cobra.Command{
+	Use:   "services",
+	Short: "List the services and their state",
+	Args:  cobra.NoArgs,
+	RunE:  servicesFunc,
+}
+
+func init() {
+	rootCmd.AddCommand(servicesCmd)
+}
+
+func servicesFunc(cmd *cobra.Command, args []string) error {
+	db, err := sql.Open("sqlite3", getSettings().DbPath+"?_fk=1")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	services, err := models.Services(
+		qm.Load(models.ServiceRels.File),
+		models.ServiceWhere.FileID.IsNotNull(),
+		qm.OrderBy("name"),
+	).All(context.Background(), db)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tFILE\tSTATE\tCOLOR\tDOMAINS")
+
+	for _, s := range services {
+		config := getFullConfig(s)
+
+		color := "-"
+		if config.ActiveColor != "" {
+			color = config.ActiveColor
+		}
+
+		domains := "-"
+		if len(config.Domains) > 0 {
+			domains = strings.Join(config.Domains, ",")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Name, s.R.File.Path, s.State, color, domains)
+	}
+
+	return w.Flush()
+}
@@ -1,12 +1,137 @@
 package cmd
 
-var settings Settings
+import (
+	"reflect"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// settings are changed by the config file watcher while the workers
+// are running, so they are only used through getSettings and setSettings
+var (
+	settings   Settings
+	settingsMu sync.RWMutex
+)
+
+func getSettings() Settings {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+
+	return settings
+}
+
+func setSettings(s Settings) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	settings = s
+}
+
+// serviceSettingsChanged is true if settings used in the nginx
+// config files of the services are different
+func serviceSettingsChanged(old, new Settings) bool {
+	return old.DisableIpv6 != new.DisableIpv6 ||
+		old.DefaultPage != new.DefaultPage ||
+		old.ProxyProtocol != new.ProxyProtocol ||
+		!reflect.DeepEqual(old.AccessLists, new.AccessLists) ||
+		!reflect.DeepEqual(old.RealIpFrom, new.RealIpFrom) ||
+		!reflect.DeepEqual(old.LogFormats, new.LogFormats)
+}
 
 type Settings struct {
 	DbPath         string
+	StateDir       string // kept across restarts, e.g. the active colors
 	ConfigDir      string
 	ReloadDuration string
-	PurgeDuration string
+	PurgeDuration  string
 	Validity       string
-	Email          string // for Let's Encrypt
+	HealthCheck    string              // how often the blue/green upstreams are checked
+	Email          string              // for Let's Encrypt
+	DisableIpv6    bool                // Do not listen on [::] by default
+	DefaultPage    string              // Shown for unknown hosts instead of closing the connection
+	AccessLists    map[string][]string // shared lists of IPs and CIDRs, by name
+
+	// Used to generate nginx.conf
+	NginxConfPath     string
+	WorkerProcesses   string // a number or auto
+	WorkerConnections int
+	Resolver          string
+	ClientMaxBodySize string
+	Gzip              bool
+	GzipMinLength     int
+	GzipTypes         []string
+	LogFormats        map[string]string // name to format
+	AccessLogFormat   string            // name of the format used for access.log
+	RealIpFrom        []string          // trusted addresses of other proxies
+	RealIpHeader      string
+	RealIpRecursive   bool
+	ProxyProtocol     bool   // accepted on 443 and 80 from the RealIpFrom addresses
+	HttpSnippet       string // added as is to the http block
+	StreamSnippet     string // added as is to the stream block
+}
+
+const defaultLogFormat = `$remote_addr - $remote_user [$time_local] "$request" ` +
+	`$status $body_bytes_sent "$http_referer" ` +
+	`"$http_user_agent" "$http_x_forwarded_for"`
+
+func setDefaultSettings() {
+	viper.SetDefault("STATE_DIR", "/var/lib/warden")
+	viper.SetDefault("HEALTH_CHECK_TIME", "30s")
+	viper.SetDefault("NGINX_CONF_PATH", "/etc/nginx/nginx.conf")
+	viper.SetDefault("WORKER_PROCESSES", "1")
+	viper.SetDefault("WORKER_CONNECTIONS", 1024)
+	viper.SetDefault("RESOLVER", "127.0.0.11 valid=30s")
+	viper.SetDefault("CLIENT_MAX_BODY_SIZE", "4g")
+	viper.SetDefault("GZIP", true)
+	viper.SetDefault("GZIP_MIN_LENGTH", 10240)
+	viper.SetDefault("GZIP_TYPES", []string{
+		"text/plain",
+		"text/css",
+		"text/xml",
+		"text/javascript",
+		"application/x-javascript",
+		"application/xml",
+	})
+	viper.SetDefault("ACCESS_LOG_FORMAT", "main")
+	viper.SetDefault("REAL_IP_HEADER", "X-Forwarded-For")
+}
+
+// loadSettings reads the settings from the environment and config file
+func loadSettings() Settings {
+	s := Settings{
+		DbPath:         "./db",
+		StateDir:       viper.GetString("STATE_DIR"),
+		HealthCheck:    viper.GetString("HEALTH_CHECK_TIME"),
+		Email:          viper.GetString("EMAIL"),
+		ConfigDir:      viper.GetString("CONFIG_DIR"),
+		ReloadDuration: viper.GetString("CONFIG_RELOAD_TIME"),
+		PurgeDuration:  viper.GetString("CONFIG_VALIDITY"),
+		DisableIpv6:    viper.GetBool("DISABLE_IPV6"),
+		DefaultPage:    viper.GetString("DEFAULT_PAGE"),
+		AccessLists:    viper.GetStringMapStringSlice("ACCESS_LISTS"),
+
+		NginxConfPath:     viper.GetString("NGINX_CONF_PATH"),
+		WorkerProcesses:   viper.GetString("WORKER_PROCESSES"),
+		WorkerConnections: viper.GetInt("WORKER_CONNECTIONS"),
+		Resolver:          viper.GetString("RESOLVER"),
+		ClientMaxBodySize: viper.GetString("CLIENT_MAX_BODY_SIZE"),
+		Gzip:              viper.GetBool("GZIP"),
+		GzipMinLength:     viper.GetInt("GZIP_MIN_LENGTH"),
+		GzipTypes:         viper.GetStringSlice("GZIP_TYPES"),
+		LogFormats:        map[string]string{"main": defaultLogFormat},
+		AccessLogFormat:   viper.GetString("ACCESS_LOG_FORMAT"),
+		RealIpFrom:        viper.GetStringSlice("REAL_IP_FROM"),
+		RealIpHeader:      viper.GetString("REAL_IP_HEADER"),
+		RealIpRecursive:   viper.GetBool("REAL_IP_RECURSIVE"),
+		ProxyProtocol:     viper.GetBool("PROXY_PROTOCOL"),
+		HttpSnippet:       viper.GetString("HTTP_SNIPPET"),
+		StreamSnippet:     viper.GetString("STREAM_SNIPPET"),
+	}
+
+	for name, format := range viper.GetStringMapString("LOG_FORMATS") {
+		s.LogFormats[name] = format
+	}
+
+	return s
 }
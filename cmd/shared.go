@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/stephenafamo/warden/models"
+	"github.com/volatiletech/sqlboiler/queries/qm"
+)
+
+// generateSharedConfig writes the nginx config that depends on
+// all the configured services instead of a single one
+func generateSharedConfig(db *sql.DB) error {
+	services, err := models.Services(
+		qm.Load(models.ServiceRels.File),
+		models.ServiceWhere.FileID.IsNotNull(),
+		models.ServiceWhere.State.NEQ(stateNotConfigured),
+	).All(context.Background(), db)
+	if err != nil {
+		return err
+	}
+
+	err = generateDefaultServerConfig(db, services)
+	if err != nil {
+		return err
+	}
+
+	err = generateRateLimitZones(db, services)
+	if err != nil {
+		return err
+	}
+
+	err = generateCacheZones(db, services)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// refreshNginx brings the shared config up to date before reloading nginx
+func refreshNginx(db *sql.DB) error {
+	err := generateSharedConfig(db)
+	if err != nil {
+		return err
+	}
+
+	return reloadNginx()
+}
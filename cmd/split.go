@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// Percentage can be written in TOML as an integer or a float
+type Percentage float64
+
+// UnmarshalText is used by the TOML decoder for integers and floats
+func (p *Percentage) UnmarshalText(text []byte) error {
+	f, err := strconv.ParseFloat(string(text), 64)
+	if err != nil {
+		return fmt.Errorf("invalid percentage %q", text)
+	}
+
+	*p = Percentage(f)
+	return nil
+}
+
+// UpstreamTemplateStruct is a single upstream block
+type UpstreamTemplateStruct struct {
+	Unique          string
+	Upstream        []UpstreamServer
+	UpstreamOptions Options
+	Hash            string // key for consistent hashing, if set
+}
+
+// SplitTemplateStruct is an entry of the split_clients block
+type SplitTemplateStruct struct {
+	Percent  string // empty for the last group, which gets the rest
+	Upstream string
+}
+
+// UpstreamBlocks are the upstream blocks the location passes requests to
+func (l LocationTemplateStruct) UpstreamBlocks() []UpstreamTemplateStruct {
+	if l.Split == nil {
+		return []UpstreamTemplateStruct{{
+			Unique:          l.Unique,
+			Upstream:        l.Upstream,
+			UpstreamOptions: l.UpstreamOptions,
+			Hash:            l.StickyKey(),
+		}}
+	}
+
+	var blocks []UpstreamTemplateStruct
+	for _, group := range l.Split.Groups {
+		blocks = append(blocks, UpstreamTemplateStruct{
+			Unique:          l.Unique + "-" + group.Name,
+			Upstream:        group.Upstream,
+			UpstreamOptions: group.UpstreamOptions,
+			Hash:            l.StickyKey(),
+		})
+	}
+
+	return blocks
+}
+
+// SplitClients are the entries of the split_clients block of the location
+func (l LocationTemplateStruct) SplitClients() []SplitTemplateStruct {
+	var entries []SplitTemplateStruct
+
+	for i, group := range l.Split.Groups {
+		entry := SplitTemplateStruct{Upstream: l.Unique + "-" + group.Name}
+		if i < len(l.Split.Groups)-1 {
+			entry.Percent = strconv.FormatFloat(float64(group.Weight), 'f', -1, 64) + "%"
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// PassTarget is the upstream block, or the variable with the
+// upstream block, that requests are passed to
+func (l LocationTemplateStruct) PassTarget() string {
+	if l.Split == nil {
+		return l.Unique
+	}
+
+	return "$warden_split_" + nginxVariableName(l.Unique)
+}
+
+var upstreamGroupName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func validateSplit(split *Split) error {
+	if split == nil {
+		return nil
+	}
+
+	if len(split.Groups) < 2 {
+		return fmt.Errorf("traffic must be split between at least 2 upstream groups")
+	}
+
+	var total float64
+	names := map[string]bool{}
+
+	for _, group := range split.Groups {
+		if !upstreamGroupName.MatchString(group.Name) {
+			return fmt.Errorf("invalid upstream group name %q", group.Name)
+		}
+
+		if names[group.Name] {
+			return fmt.Errorf("duplicate upstream group %q", group.Name)
+		}
+		names[group.Name] = true
+
+		if group.Weight <= 0 {
+			return fmt.Errorf("the weight of upstream group %q must be positive", group.Name)
+		}
+
+		// split_clients only supports 2 decimal places. Weights such
+		// as 8.2 are not exact floats, so a little error is allowed
+		weight := float64(group.Weight) * 100
+		if math.Abs(weight-math.Round(weight)) > 1e-6 {
+			return fmt.Errorf(
+				"the weight of upstream group %q can have at most 2 decimal places",
+				group.Name,
+			)
+		}
+
+		if len(group.Upstream) == 0 {
+			return fmt.Errorf("upstream group %q has no servers", group.Name)
+		}
+
+		total += float64(group.Weight)
+	}
+
+	if math.Abs(total-100) > 0.001 {
+		return fmt.Errorf("the weights of the upstream groups add up to %g, not 100", total)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// StickyKey is the variable the upstream servers are chosen by.
+// Empty if the location does not use sticky sessions
+func (l LocationTemplateStruct) StickyKey() string {
+	if l.Sticky == nil {
+		return ""
+	}
+
+	return "$warden_sticky_" + nginxVariableName(l.Unique)
+}
+
+// StickySource is the variable with the cookie or header
+func (s Sticky) StickySource() string {
+	if s.Header != "" {
+		return "$http_" + strings.ToLower(nginxVariableName(s.Header))
+	}
+
+	return "$cookie_" + s.Cookie
+}
+
+// SetCookie is the Set-Cookie header sent when the client does not
+// have the routing cookie yet
+func (s Sticky) SetCookie(key string) string {
+	cookie := s.Cookie + "=" + key + "; Path=/; HttpOnly"
+	if s.MaxAge > 0 {
+		cookie += "; Max-Age=" + strconv.FormatUint(uint64(s.MaxAge), 10)
+	}
+	if s.Secure {
+		cookie += "; Secure"
+	}
+
+	return cookie
+}
+
+var cookieName = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// load balancing directives that can not be used with sticky sessions
+var balancingOptions = []string{"hash", "ip_hash", "least_conn", "random"}
+
+func validateSticky(location LocationTemplateStruct) error {
+	sticky := location.Sticky
+	if sticky == nil {
+		return nil
+	}
+
+	if (sticky.Cookie == "") == (sticky.Header == "") {
+		return fmt.Errorf("sticky sessions need either a Cookie or a Header")
+	}
+
+	if sticky.Cookie != "" && !cookieName.MatchString(sticky.Cookie) {
+		return fmt.Errorf("invalid cookie name %q", sticky.Cookie)
+	}
+
+	if sticky.Header != "" && !headerName.MatchString(sticky.Header) {
+		return fmt.Errorf("invalid header name %q", sticky.Header)
+	}
+
+	for _, block := range location.UpstreamBlocks() {
+		for _, option := range balancingOptions {
+			if _, ok := block.UpstreamOptions[option]; ok {
+				return fmt.Errorf(
+					"%s can not be used with sticky sessions for location %q",
+					option,
+					location.Match,
+				)
+			}
+		}
+	}
+
+	return nil
+}
@@ -1,15 +1,35 @@
 package cmd
 
 import (
+    "strings"
     "text/template"
 )
 
 var t *template.Template
 
+var quoteReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// quote makes a string safe to use as a single nginx argument
+func quote(s string) string {
+    return `"` + quoteReplacer.Replace(s) + `"`
+}
+
 func init() {
-    t = template.New("configs")
+    t = template.New("configs").Funcs(template.FuncMap{
+        "quote":    quote,
+        "join":     strings.Join,
+        "variable": nginxVariableName,
+        "headerVariable": func(header string) string {
+            return strings.ToLower(nginxVariableName(header))
+        },
+    })
+
+    err := parsePartials(t)
+    if err != nil {
+        panic(err)
+    }
 
-    err := parseHttp(t)
+    err = parseHttp(t)
     if err != nil {
         panic(err)
     }
@@ -28,76 +48,672 @@ func init() {
     if err != nil {
         panic(err)
     }
+
+    err = parseSni(t)
+    if err != nil {
+        panic(err)
+    }
+
+    err = parseDefaultServer(t)
+    if err != nil {
+        panic(err)
+    }
+
+    err = parseNginxConf(t)
+    if err != nil {
+        panic(err)
+    }
+
+    err = parseRateLimitZones(t)
+    if err != nil {
+        panic(err)
+    }
+
+    err = parseCacheZones(t)
+    if err != nil {
+        panic(err)
+    }
 }
 
-func parseHttp(t *template.Template) error {
-    nt := t.New("httpBase")
+// parsePartials defines the blocks shared by the http and https templates
+func parsePartials(t *template.Template) error {
+    nt := t.New("upstream")
     _, err := nt.Parse(`
-        {{- if .Location -}}
         upstream {{.Unique}} {
             {{range .Upstream }}
             server {{.Address}}{{range .Parameters}} {{.}}{{end}};
             {{- end}}
-            {{range $i, $x := $.UpstreamOptions }}
+            {{range $i, $x := .UpstreamOptions }}
             {{ $i }} {{ $x }};
             {{- end}}
+            {{- if .Hash}}
+            hash {{.Hash}} consistent;
+            {{- end}}
         }
+    `)
+    if err != nil {
+        return err
+    }
+
+    // Everything a service needs in the http context
+    nt = t.New("httpContext")
+    _, err = nt.Parse(`
+        {{- range .MirrorUpstreams}}
+        {{template "upstream" .}}
         {{- end}}
 
-        {{range $i, $x := $.Locations }}
-        upstream {{$.Unique}}-{{$i}} {
-            {{range $x.Upstream }}
-            server {{.Address}}{{range .Parameters}} {{.}}{{end}};
+        {{- with .AccessLog}}
+        {{- if .ErrorsOnly}}
+
+        map $status $warden_log_errors_{{$.Variable}} {
+            ~^[45] 1;
+            default 0;
+        }
+        {{- end}}
+        {{- with .SamplePercent}}
+
+        split_clients "$request_id" $warden_log_sample_{{$.Variable}} {
+            {{.}} 1;
+            * 0;
+        }
+        {{- end}}
+        {{- if and .ErrorsOnly .SamplePercent}}
+
+        map "$warden_log_errors_{{$.Variable}}$warden_log_sample_{{$.Variable}}" $warden_log_{{$.Variable}} {
+            "11" 1;
+            default 0;
+        }
+        {{- end}}
+        {{- end}}
+
+        {{- range $location := .AllLocations}}
+        {{- with .Mirror}}
+        {{- with .SamplePercent}}
+
+        split_clients "$request_id" $warden_mirror_{{variable $location.Unique}} {
+            {{.}} 1;
+            * "";
+        }
+        {{- end}}
+        {{- end}}
+        {{- end}}
+
+        {{- range $location := .AllLocations}}
+        {{- with .Sticky}}
+
+        map {{.StickySource}} {{$location.StickyKey}} {
+            "" $request_id;
+            default {{.StickySource}};
+        }
+        {{- if .Cookie}}
+
+        map {{.StickySource}} {{$location.StickyKey}}_cookie {
+            "" {{quote (.SetCookie $location.StickyKey)}};
+            default "";
+        }
+        {{- end}}
+        {{- end}}
+        {{- range .UpstreamBlocks}}
+        {{template "upstream" .}}
+        {{- end}}
+        {{- with .Split}}
+
+        split_clients {{quote .Key}} {{$location.PassTarget}} {
+            {{- range $location.SplitClients}}
+            {{if .Percent}}{{.Percent}}{{else}}*{{end}} {{.Upstream}};
             {{- end}}
-            {{range $j, $y := $x.UpstreamOptions }}
-            {{ $j }} {{ $y }};
+        }
+        {{- end}}
+        {{- end}}
+
+        {{if .Maintenance -}}
+        geo $warden_maintenance_{{.Variable}} {
+            default 1;
+            {{range .MaintenanceAllow }}
+            {{.}} 0;
             {{- end}}
         }
         {{- end}}
 
-        server {
-            listen 80;
-            listen [::]:80;
-            server_name {{- range .Domains}} {{.}}{{end}};
-            {{range $i, $x := $.ServerOptions }}
-            {{ $i }} {{ $x }};
+        {{- range $location := .AllLocations}}
+        {{- with .HstsValue}}
+
+        map $https $warden_hsts_{{variable $location.Unique}} {
+            default "";
+            on {{quote .}};
+        }
+        {{- end}}
+        {{- end}}
+
+        {{- range $location := .AllLocations}}
+        {{- with .Cors}}
+
+        map $http_origin $warden_cors_{{variable $location.Unique}} {
+            {{- if .AllowsAnyOrigin}}
+            default "*";
+            {{- else}}
+            default "";
+            {{- range .OriginRegexes}}
+            {{quote .}} $http_origin;
+            {{- end}}
             {{- end}}
+        }
 
-            location ^~ /.well-known/acme-challenge {
-                default_type "text/plain";
-                root /docker/challenge/{{$.Unique}};
-                allow all;
-            }
+        map "$request_method:$http_access_control_request_method" $warden_cors_preflight_{{variable $location.Unique}} {
+            default 0;
+            "~^OPTIONS:.+" 1;
+        }
+        {{- end}}
+        {{- end}}
+    `)
+    if err != nil {
+        return err
+    }
+
+    nt = t.New("proxyLocation")
+    _, err = nt.Parse(`
+            location {{.Match}} {
+                {{- if .Maintenance}}
+                if ($warden_maintenance_{{.Variable}}) {
+                    return 503;
+                }
+                {{- end}}
+                {{- with .Cors}}
+                {{- $origin := printf "$warden_cors_%s" (variable $.Unique)}}
+                if ($warden_cors_preflight_{{variable $.Unique}}) {
+                    add_header Access-Control-Allow-Origin {{$origin}} always;
+                    add_header Access-Control-Allow-Methods {{quote (join .AllowMethods ", ")}} always;
+                    {{- if .AllowHeaders}}
+                    add_header Access-Control-Allow-Headers {{quote (join .AllowHeaders ", ")}} always;
+                    {{- else}}
+                    add_header Access-Control-Allow-Headers $http_access_control_request_headers always;
+                    {{- end}}
+                    {{- if .AllowCredentials}}
+                    add_header Access-Control-Allow-Credentials true always;
+                    {{- end}}
+                    {{- if .MaxAge}}
+                    add_header Access-Control-Max-Age {{.MaxAge}} always;
+                    {{- end}}
+                    add_header Vary Origin always;
+                    return 204;
+                }
+                add_header Access-Control-Allow-Origin {{$origin}} always;
+                {{- if .AllowCredentials}}
+                add_header Access-Control-Allow-Credentials true always;
+                {{- end}}
+                {{- if .ExposeHeaders}}
+                add_header Access-Control-Expose-Headers {{quote (join .ExposeHeaders ", ")}} always;
+                {{- end}}
+                add_header Vary Origin always;
+                {{- end}}
+                {{- range .Rewrites}}
+                rewrite {{quote .Regex}} {{quote .Replacement}}{{if .Flag}} {{.Flag}}{{end}};
+                {{- end}}
+                {{- with .PrefixRewrite}}
+                rewrite {{quote (index . 0)}} {{quote (index . 1)}} break;
+                {{- end}}
+                {{- if .HstsValue}}
+                add_header Strict-Transport-Security $warden_hsts_{{variable $.Unique}} always;
+                {{- end}}
+                {{- template "securityHeaders" .SecurityHeaders}}
+                {{- if and .Sticky .Sticky.Cookie}}
+                add_header Set-Cookie {{.StickyKey}}_cookie always;
+                {{- end}}
+                {{- template "accessRules" .Access}}
+                {{- with .BasicAuth}}
+                auth_basic {{quote .Realm}};
+                auth_basic_user_file {{$.HtpasswdPath}};
+                {{- end}}
+                {{- with .RateLimit}}
+                limit_req zone={{$.RateLimitZone}}{{if .Burst}} burst={{.Burst}}{{end}}{{if .NoDelay}} nodelay{{end}};
+                {{- if .Status}}
+                limit_req_status {{.Status}};
+                {{- end}}
+                {{- end}}
+                {{- if .IsGrpc}}
+                grpc_pass {{.Protocol}}://{{.PassTarget}};
 
-            {{if .Location -}}
-            location {{.Location}} {
-                proxy_pass http://{{.Unique}};
+                grpc_set_header Host $host;
+                grpc_set_header X-Real-IP $remote_addr;
+                grpc_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+                grpc_set_header X-Forwarded-Proto $scheme;
+
+                {{- if not (or (index .Options "grpc_read_timeout") (and .Timeouts .Timeouts.Read))}}
+                grpc_read_timeout 1h;
+                {{- end}}
+                {{- if not (or (index .Options "grpc_send_timeout") (and .Timeouts .Timeouts.Send))}}
+                grpc_send_timeout 1h;
+                {{- end}}
+                {{template "grpcErrorCodes"}}
+                {{- else if eq .Protocol "fastcgi"}}
+                root {{.Root}};
+
+                fastcgi_pass {{.PassTarget}};
+                fastcgi_index {{.Index}};
+
+                include fastcgi_params;
+                fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
+                fastcgi_param HTTP_X_FORWARDED_FOR $proxy_add_x_forwarded_for;
+                fastcgi_param HTTP_X_FORWARDED_PROTO $scheme;
+                {{- else if eq .Protocol "uwsgi"}}
+                {{- if .Root}}
+                root {{.Root}};
+                {{- end}}
+
+                uwsgi_pass uwsgi://{{.PassTarget}};
+
+                include uwsgi_params;
+                uwsgi_param HTTP_X_FORWARDED_FOR $proxy_add_x_forwarded_for;
+                uwsgi_param HTTP_X_FORWARDED_PROTO $scheme;
+                {{- else}}
+                proxy_pass {{.Protocol}}://{{.PassTarget}};
 
                 proxy_set_header Host $http_host;
                 proxy_set_header X-Real-IP $remote_addr;
                 proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
                 proxy_set_header X-Forwarded-Proto $scheme;
+                {{- end}}
+                {{- range .UpstreamTlsDirectives}}
+                {{.}}
+                {{- end}}
+                {{- with .Timeouts}}
+                {{- with .Connect}}
+                {{$.DirectivePrefix}}_connect_timeout {{.}};
+                {{- end}}
+                {{- with .Send}}
+                {{$.DirectivePrefix}}_send_timeout {{.}};
+                {{- end}}
+                {{- with .Read}}
+                {{$.DirectivePrefix}}_read_timeout {{.}};
+                {{- end}}
+                {{- end}}
+                {{- with .Retry}}
+                {{- with .NextUpstream}}
+                {{$.DirectivePrefix}}_next_upstream{{range .}} {{.}}{{end}};
+                {{- end}}
+                {{- with .Tries}}
+                {{$.DirectivePrefix}}_next_upstream_tries {{.}};
+                {{- end}}
+                {{- with .Timeout}}
+                {{$.DirectivePrefix}}_next_upstream_timeout {{.}};
+                {{- end}}
+                {{- end}}
+                {{- with .HeaderRules}}
+                {{- range $.RequestHeaderDirectives}}
+                {{.}}
+                {{- end}}
+                {{- range $.ResponseHeaderDirectives}}
+                {{.}}
+                {{- end}}
+                {{- end}}
+                {{- with .Cache}}
+                {{- $prefix := $.DirectivePrefix}}
+
+                {{$prefix}}_cache {{$.CacheZone}};
+                {{$prefix}}_cache_key {{quote .Key}};
+                {{- range $status := .ValidStatuses}}
+                {{$prefix}}_cache_valid {{$status}} {{index $.Cache.Valid $status}};
+                {{- end}}
+                {{- if .Bypass}}
+                {{$prefix}}_cache_bypass{{range .Bypass}} {{.}}{{end}};
+                {{$prefix}}_no_cache{{range .Bypass}} {{.}}{{end}};
+                {{- end}}
+                {{- if .UseStale}}
+                {{$prefix}}_cache_use_stale{{range .UseStale}} {{.}}{{end}};
+                {{- end}}
+                {{- if .BackgroundUpdate}}
+                {{$prefix}}_cache_background_update on;
+                {{- end}}
+                {{- if .Lock}}
+                {{$prefix}}_cache_lock on;
+                {{- end}}
+                {{- if .MinUses}}
+                {{$prefix}}_cache_min_uses {{.MinUses}};
+                {{- end}}
+                {{- if .StatusHeader}}
+                add_header X-Cache-Status $upstream_cache_status always;
+                {{- end}}
+                {{- end}}
+                {{- with .Compression}}
+
+                {{- if .Disable}}
+                gzip off;
+                {{- else}}
+                gzip on;
+                {{- if .Level}}
+                gzip_comp_level {{.Level}};
+                {{- end}}
+                {{- if .MinLength}}
+                gzip_min_length {{.MinLength}};
+                {{- end}}
+                {{- if .Types}}
+                gzip_types{{range .Types}} {{.}}{{end}};
+                {{- end}}
+                {{- if .UseBrotli}}
+                brotli on;
+                {{- if .BrotliLevel}}
+                brotli_comp_level {{.BrotliLevel}};
+                {{- end}}
+                {{- if .MinLength}}
+                brotli_min_length {{.MinLength}};
+                {{- end}}
+                {{- if .Types}}
+                brotli_types{{range .Types}} {{.}}{{end}};
+                {{- end}}
+                {{- end}}
+                {{- end}}
+                {{- end}}
+                {{- with .Mirror}}
+
+                mirror /_warden_mirror/{{$.Unique}};
+                {{- if .NoRequestBody}}
+                mirror_request_body off;
+                {{- end}}
+                {{- end}}
+                {{- with .Auth}}
+
+                auth_request /_warden_auth/{{$.Unique}};
+                {{- range .ResponseHeaders}}
+                auth_request_set $warden_auth_{{headerVariable .}} $upstream_http_{{headerVariable .}};
+                {{$.SetHeader . (printf "$warden_auth_%s" (headerVariable .))}}
+                {{- end}}
+                {{- if .SignIn}}
+                error_page 401 = @warden_signin_{{variable $.Unique}};
+                {{- range $code, $path := $.ErrorPageFiles }}
+                error_page {{$code}} /warden-errors/{{$code}}.html;
+                {{- end}}
+                {{- end}}
+                {{- end}}
+                {{- with .ClientAuth}}
 
-                {{range $i, $x := $.LocationOptions }}
+                {{$.SetHeader .SubjectHeader "$ssl_client_s_dn"}}
+                {{$.SetHeader .VerifyHeader "$ssl_client_verify"}}
+                {{- end}}
+
+                {{range $i, $x := .Options }}
                 {{ $i }} {{ $x }};
                 {{- end}}
             }
+    `)
+    if err != nil {
+        return err
+    }
+
+    nt = t.New("accessLog")
+    _, err = nt.Parse(`
+            set $warden_service {{quote .Unique}};
+            {{- with .AccessLog}}
+            access_log {{.Path}} {{.LogFormat}}
+                {{- with .Buffer}} buffer={{.}}{{end}}
+                {{- with .Flush}} flush={{.}}{{end}}
+                {{- with $.AccessLogCondition}} if={{.}}{{end}};
+            {{- end}}
+    `)
+    if err != nil {
+        return err
+    }
+
+    nt = t.New("proxyProtocolRealIp")
+    _, err = nt.Parse(`
+            {{- with .}}
+            {{- range .}}
+            set_real_ip_from {{.}};
             {{- end}}
+            real_ip_header proxy_protocol;
+            {{- end}}
+    `)
+    if err != nil {
+        return err
+    }
+
+    nt = t.New("securityHeaders")
+    _, err = nt.Parse(`
+                {{- with .}}
+                {{- range .Headers}}
+                add_header {{.Name}} {{quote .Value}} always;
+                {{- end}}
+                {{- end}}
+    `)
+    if err != nil {
+        return err
+    }
 
-            {{range $i, $x := $.Locations }}
-            location {{$x.Match}} {
-                proxy_pass http://{{$.Unique}}-{{$i}};
+    nt = t.New("accessRules")
+    _, err = nt.Parse(`
+                {{- with .}}
+                {{- range .Deny}}
+                deny {{.}};
+                {{- end}}
+                {{- range .Allow}}
+                allow {{.}};
+                {{- end}}
+                {{- if .Allow}}
+                deny all;
+                {{- end}}
+                {{- end}}
+    `)
+    if err != nil {
+        return err
+    }
+
+    // The mirror subrequests use short timeouts, and their
+    // responses and errors are ignored by nginx
+    nt = t.New("mirrorLocations")
+    _, err = nt.Parse(`
+            {{- range $location := .AllLocations}}
+            {{- with $location.Mirror}}
+
+            location = /_warden_mirror/{{$location.Unique}} {
+                internal;
+                {{- if .SamplePercent}}
+                if ($warden_mirror_{{variable $location.Unique}} = "") {
+                    return 204;
+                }
+                {{- end}}
+                proxy_pass http://{{$location.MirrorUpstream}}$request_uri;
+                {{- if .NoRequestBody}}
+                proxy_pass_request_body off;
+                proxy_set_header Content-Length "";
+                {{- end}}
 
                 proxy_set_header Host $http_host;
                 proxy_set_header X-Real-IP $remote_addr;
                 proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
                 proxy_set_header X-Forwarded-Proto $scheme;
 
-                {{range $j, $y := $x.Options -}}
-                {{ $j }} {{ $y }};
-                {{- end}}
+                proxy_connect_timeout {{.Timeout}};
+                proxy_send_timeout {{.Timeout}};
+                proxy_read_timeout {{.Timeout}};
+                proxy_next_upstream off;
+                access_log off;
             }
-            {{end}}
+            {{- end}}
+            {{- end}}
+    `)
+    if err != nil {
+        return err
+    }
+
+    // The subrequests of locations with an Auth
+    nt = t.New("authLocations")
+    _, err = nt.Parse(`
+            {{- range $location := .AllLocations}}
+            {{- with $location.Auth}}
+
+            location = /_warden_auth/{{$location.Unique}} {
+                internal;
+                proxy_pass {{.Url}};
+                proxy_pass_request_body off;
+
+                proxy_set_header Content-Length "";
+                proxy_set_header Host $http_host;
+                proxy_set_header X-Real-IP $remote_addr;
+                proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+                proxy_set_header X-Forwarded-Proto $scheme;
+                proxy_set_header X-Forwarded-Host $http_host;
+                proxy_set_header X-Forwarded-Uri $request_uri;
+                proxy_set_header X-Original-URI $request_uri;
+                proxy_set_header X-Original-Method $request_method;
+            }
+            {{- if .SignIn}}
+
+            location @warden_signin_{{variable $location.Unique}} {
+                return 302 {{.SignInRedirect}};
+            }
+            {{- end}}
+            {{- end}}
+            {{- end}}
+    `)
+    if err != nil {
+        return err
+    }
+
+    nt = t.New("errorPages")
+    _, err = nt.Parse(`
+            {{- if .ErrorPageFiles}}
+            proxy_intercept_errors on;
+            {{- end}}
+            {{range $code, $path := .ErrorPageFiles }}
+            error_page {{$code}} /warden-errors/{{$code}}.html;
+            location = /warden-errors/{{$code}}.html {
+                internal;
+                alias {{$path}};
+            }
+            {{- end}}
+    `)
+    if err != nil {
+        return err
+    }
+
+    err = parseGrpcErrors(t)
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// parseGrpcErrors maps the errors nginx generates to gRPC status codes
+// so gRPC clients get a proper error instead of a html page
+func parseGrpcErrors(t *template.Template) error {
+    nt := t.New("grpcErrorCodes")
+    _, err := nt.Parse(`
+                error_page 400 = @grpc_internal;
+                error_page 401 = @grpc_unauthenticated;
+                error_page 403 = @grpc_permission_denied;
+                error_page 404 = @grpc_unimplemented;
+                error_page 405 = @grpc_internal;
+                error_page 408 = @grpc_deadline_exceeded;
+                error_page 413 = @grpc_resource_exhausted;
+                error_page 414 = @grpc_resource_exhausted;
+                error_page 415 = @grpc_internal;
+                error_page 426 = @grpc_internal;
+                error_page 429 = @grpc_unavailable;
+                error_page 495 = @grpc_unauthenticated;
+                error_page 496 = @grpc_unauthenticated;
+                error_page 497 = @grpc_internal;
+                error_page 500 = @grpc_internal;
+                error_page 501 = @grpc_internal;
+                error_page 502 = @grpc_unavailable;
+                error_page 503 = @grpc_unavailable;
+                error_page 504 = @grpc_deadline_exceeded;
+    `)
+    if err != nil {
+        return err
+    }
+
+    nt = t.New("grpcErrors")
+    _, err = nt.Parse(`
+            {{- if .Grpc}}
+
+            location @grpc_internal {
+                default_type application/grpc;
+                add_header grpc-status 13;
+                add_header grpc-message "internal error";
+                return 204;
+            }
+
+            location @grpc_unauthenticated {
+                default_type application/grpc;
+                add_header grpc-status 16;
+                add_header grpc-message "unauthenticated";
+                return 204;
+            }
+
+            location @grpc_permission_denied {
+                default_type application/grpc;
+                add_header grpc-status 7;
+                add_header grpc-message "permission denied";
+                return 204;
+            }
+
+            location @grpc_unimplemented {
+                default_type application/grpc;
+                add_header grpc-status 12;
+                add_header grpc-message "unimplemented";
+                return 204;
+            }
+
+            location @grpc_deadline_exceeded {
+                default_type application/grpc;
+                add_header grpc-status 4;
+                add_header grpc-message "deadline exceeded";
+                return 204;
+            }
+
+            location @grpc_resource_exhausted {
+                default_type application/grpc;
+                add_header grpc-status 8;
+                add_header grpc-message "resource exhausted";
+                return 204;
+            }
+
+            location @grpc_unavailable {
+                default_type application/grpc;
+                add_header grpc-status 14;
+                add_header grpc-message "unavailable";
+                return 204;
+            }
+            {{- end}}
+    `)
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func parseHttp(t *template.Template) error {
+    nt := t.New("httpBase")
+    _, err := nt.Parse(`
+        {{- template "httpContext" .}}
+
+        server {
+            {{- range .HttpListen}}
+            listen {{.}};
+            {{- end}}
+            server_name {{- range .Domains}} {{.}}{{end}};
+            {{- template "accessLog" .}}
+            {{- template "proxyProtocolRealIp" .HttpRealIpFrom}}
+            {{range $i, $x := $.ServerOptions }}
+            {{ $i }} {{ $x }};
+            {{- end}}
+            {{- template "securityHeaders" .SecurityHeaders}}
+
+            location ^~ /.well-known/acme-challenge {
+                default_type "text/plain";
+                root /docker/challenge/{{$.Unique}};
+                allow all;
+            }
+
+            {{template "errorPages" .}}
+            {{template "grpcErrors" .}}
+            {{template "authLocations" .}}
+            {{template "mirrorLocations" .}}
+
+            {{range .AllLocations -}}
+            {{template "proxyLocation" .}}
+            {{- end}}
         }
     `)
     if err != nil {
@@ -120,10 +736,18 @@ func parseStream(t *template.Template) error {
         }
 
         server {
-            listen 80;
-            listen [::]:80;
+            {{- range .StreamListen}}
+            listen {{.}};
+            {{- end}}
 
             proxy_pass {{.Unique}};
+            {{- with .ProxyProtocol}}{{if .Send}}
+            proxy_protocol on;
+            {{- end}}{{end}}
+            {{- range .StreamTlsDirectives}}
+            {{.}}
+            {{- end}}
+            {{- template "accessRules" .Access}}
             {{range $i, $x := $.ServerOptions }}
             {{ $i }} {{ $x }};
             {{- end}}
@@ -140,9 +764,12 @@ func parseHttps(t *template.Template) error {
     nt := t.New("https")
     _, err := nt.Parse(`
         server {
-            listen 4343 ssl http2;
-            listen [::]:4343 ssl http2;
+            {{- range .HttpsListen}}
+            listen {{.}};
+            {{- end}}
             server_name {{- range .Domains}} {{.}}{{end}};
+            {{- template "accessLog" .}}
+            {{- template "proxyProtocolRealIp" .HttpsRealIpFrom}}
             {{range $i, $x := $.ServerOptions }}
             {{ $i }} {{ $x }};
             {{- end}}
@@ -157,7 +784,21 @@ func parseHttps(t *template.Template) error {
             ssl_ciphers 'ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-AES128-SHA256:ECDHE-RSA-AES128-SHA256:ECDHE-ECDSA-AES128-SHA:ECDHE-RSA-AES256-SHA384:ECDHE-RSA-AES128-SHA:ECDHE-ECDSA-AES256-SHA384:ECDHE-ECDSA-AES256-SHA:ECDHE-RSA-AES256-SHA:DHE-RSA-AES128-SHA256:DHE-RSA-AES128-SHA:DHE-RSA-AES256-SHA256:DHE-RSA-AES256-SHA:ECDHE-ECDSA-DES-CBC3-SHA:ECDHE-RSA-DES-CBC3-SHA:EDH-RSA-DES-CBC3-SHA:AES128-GCM-SHA256:AES256-GCM-SHA384:AES128-SHA256:AES256-SHA256:AES128-SHA:AES256-SHA:DES-CBC3-SHA:!DSS';
             ssl_stapling on;
             ssl_stapling_verify on;
-            add_header Strict-Transport-Security max-age=15768000;
+            {{- with .ClientAuth}}
+
+            ssl_client_certificate {{.CaFile}};
+            ssl_verify_client {{if eq .Verify "optional"}}optional{{else}}on{{end}};
+            {{- with .Depth}}
+            ssl_verify_depth {{.}};
+            {{- end}}
+            {{- with .CrlFile}}
+            ssl_crl {{.}};
+            {{- end}}
+            {{- end}}
+            {{- with .ServerHstsValue}}
+            add_header Strict-Transport-Security {{quote .}} always;
+            {{- end}}
+            {{- template "securityHeaders" .SecurityHeaders}}
 
             location ^~ /.well-known/acme-challenge {
                 default_type "text/plain";
@@ -165,36 +806,14 @@ func parseHttps(t *template.Template) error {
                 allow all;
             }
 
-            {{if .Location -}}
-            location {{.Location}} {
-                proxy_pass http://{{.Unique}};
-
-                proxy_set_header Host $http_host;
-                proxy_set_header X-Real-IP $remote_addr;
-                proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-                proxy_set_header X-Forwarded-Proto $scheme;
+            {{template "errorPages" .}}
+            {{template "grpcErrors" .}}
+            {{template "authLocations" .}}
+            {{template "mirrorLocations" .}}
 
-                {{range $i, $x := $.LocationOptions }}
-                {{ $i }} {{ $x }};
-                {{- end}}
-            }
+            {{range .AllLocations -}}
+            {{template "proxyLocation" .}}
             {{- end}}
-
-            {{range $i, $x := $.Locations }}
-            location {{$x.Match}} {
-                proxy_pass http://{{$.Unique}}-{{$i}};
-
-                proxy_set_header Host $http_host;
-                proxy_set_header X-Real-IP $remote_addr;
-                proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-                proxy_set_header X-Forwarded-Proto $scheme;
-
-                {{range $j, $y := $x.Options -}}
-                {{ $j }} {{ $y }};
-                {{- end}}
-            }
-            {{- end}}
-
         }
     `)
     if err != nil {
@@ -207,32 +826,15 @@ func parseHttps(t *template.Template) error {
 func parseHttptoHttps(t *template.Template) error {
     nt := t.New("httptoHttps")
     _, err := nt.Parse(`
-        {{if .Location -}}
-        upstream {{.Unique}} {
-            {{range .Upstream }}
-            server {{.Address}}{{range .Parameters}} {{.}}{{end}};
-            {{- end}}
-            {{range $i, $x := $.UpstreamOptions }}
-            {{ $i }} {{ $x }};
-            {{- end}}
-        }
-        {{- end}}
-
-        {{range $i, $x := $.Locations }}
-        upstream {{$.Unique}}-{{$i}} {
-            {{range $x.Upstream }}
-            server {{.Address}}{{range .Parameters}} {{.}}{{end}};
-            {{- end}}
-            {{range $j, $y := $x.UpstreamOptions }}
-            {{ $j }} {{ $y }};
-            {{- end}}
-        }
-        {{- end}}
+        {{- template "httpContext" .}}
 
         server {
-            listen 80;
-            listen [::]:80;
+            {{- range .HttpListen}}
+            listen {{.}};
+            {{- end}}
             server_name {{- range .Domains}} {{.}}{{end}};
+            {{- template "accessLog" .}}
+            {{- template "proxyProtocolRealIp" .HttpRealIpFrom}}
             {{range $i, $x := $.ServerOptions }}
             {{ $i }} {{ $x }};
             {{- end}}
@@ -243,15 +845,62 @@ func parseHttptoHttps(t *template.Template) error {
                 allow all;
             }
 
-            {{if .Location -}}
-            location {{.Location}} {
+            {{range .AllLocations -}}
+            location {{.Match}} {
                 return 301 https://$server_name$request_uri;
             }
             {{- end}}
-            {{range $i, $x := $.Locations }}
-            location {{$x.Match}} {
-                return 301 https://$server_name$request_uri;
+        }
+    `)
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// parseSni is for the entries of the SNI map in the stream block.
+// Used when the HTTPS server of a service does not listen on 4343
+func parseSni(t *template.Template) error {
+    nt := t.New("sni")
+    _, err := nt.Parse(`
+        {{- range .Domains}}
+        {{.}} {{$.SniUpstream}};
+        {{- end}}
+    `)
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// parseDefaultServer is for the server that catches unknown hosts
+func parseDefaultServer(t *template.Template) error {
+    nt := t.New("defaultServer")
+    _, err := nt.Parse(`
+        server {
+            {{- range .HttpListen}}
+            listen {{.}};
+            {{- end}}
+            {{- range .HttpsListen}}
+            listen {{.}};
+            {{- end}}
+            server_name _;
+            set $warden_service "";
+            {{- template "proxyProtocolRealIp" .RealIpFrom}}
+
+            ssl_certificate {{ .CertPath }};
+            ssl_certificate_key {{ .KeyPath }};
+
+            {{if .Page -}}
+            root {{.PageDir}};
+
+            location / {
+                try_files /{{.Page}} =404;
             }
+            {{- else -}}
+            return 444;
             {{- end}}
         }
     `)
@@ -261,3 +910,140 @@ func parseHttptoHttps(t *template.Template) error {
 
     return nil
 }
+
+// parseNginxConf is for the main nginx.conf, generated from the settings
+func parseNginxConf(t *template.Template) error {
+    nt := t.New("nginxConf")
+    _, err := nt.Parse(`
+{{- range .LoadModules -}}
+load_module {{.}};
+{{end -}}
+user  nginx;
+worker_processes  {{.WorkerProcesses}};
+
+error_log  /var/log/nginx/error.log warn;
+pid        /var/run/nginx.pid;
+
+
+events {
+    worker_connections  {{.WorkerConnections}};
+}
+
+
+http {
+    absolute_redirect off;
+    port_in_redirect off;
+
+    include       /etc/nginx/mime.types;
+    default_type  application/octet-stream;
+    client_max_body_size {{.ClientMaxBodySize}};
+
+    resolver {{.Resolver}};
+    {{range $name, $format := .LogFormats }}
+    log_format {{$name}} {{quote $format}};
+    {{- end}}
+    log_format warden_json escape=json {{quote .JsonLogFormat}};
+
+    access_log  /var/log/nginx/access.log  {{.AccessLogFormat}};
+
+    sendfile        on;
+    #tcp_nopush     on;
+
+    keepalive_timeout  65;
+    {{if .RealIpFrom}}
+    {{- range .RealIpFrom}}
+    set_real_ip_from {{.}};
+    {{- end}}
+    real_ip_header {{.RealIpHeader}};
+    {{- if .RealIpRecursive}}
+    real_ip_recursive on;
+    {{- end}}
+    {{end}}
+
+    {{if .Gzip -}}
+    gzip on;
+    gzip_vary on;
+    gzip_min_length {{.GzipMinLength}};
+    gzip_proxied expired no-cache no-store private auth;
+    gzip_types {{- range .GzipTypes}} {{.}}{{end}};
+    gzip_disable "MSIE [1-6]\.";
+    {{- else -}}
+    gzip off;
+    {{- end}}
+    {{if .HttpSnippet}}
+    {{.HttpSnippet}}
+    {{end}}
+    include /etc/nginx/conf.d/global/*.conf;
+    include /etc/nginx/conf.d/http/*.conf;
+    include /etc/nginx/conf.d/*.conf;
+}
+
+stream {
+    {{- if .StreamSnippet}}
+    {{.StreamSnippet}}
+    {{end}}
+    {{- range .RealIpFrom}}
+    set_real_ip_from {{.}};
+    {{- end}}
+    include /etc/nginx/conf.d/streams/*.conf;
+
+    map $ssl_preread_server_name $sni_upstream {
+        hostnames;
+        default ssl_upstream;
+
+        include /etc/nginx/conf.d/sni/*.conf;
+    }
+
+    upstream ssl_upstream {
+        server 127.0.0.1:4343;
+    }
+
+    server {
+        listen 443{{if .ProxyProtocol}} proxy_protocol{{end}};
+
+        ssl_preread on;
+        proxy_pass $sni_upstream;
+        {{- if .ProxyProtocol}}
+        proxy_protocol on;
+        {{- end}}
+    }
+}
+`)
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// parseRateLimitZones is for the zones used by the rate limits
+// of all services. It is included in the http context
+func parseRateLimitZones(t *template.Template) error {
+    nt := t.New("rateLimitZones")
+    _, err := nt.Parse(`
+        {{- range $zone, $x := . }}
+        limit_req_zone {{$x.Key}} zone={{$zone}}:10m rate={{$x.Rate}};
+        {{- end}}
+    `)
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// parseCacheZones is for the cache zones of all services.
+// It is included in the http context
+func parseCacheZones(t *template.Template) error {
+    nt := t.New("cacheZones")
+    _, err := nt.Parse(`
+        {{- range $zone, $x := . }}
+        proxy_cache_path {{$x.Path}} levels=1:2 keys_zone={{$zone}}:{{$x.KeysSize}} max_size={{$x.MaxSize}} inactive={{$x.Inactive}} use_temp_path=off;
+        {{- end}}
+    `)
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
@@ -0,0 +1,475 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// renderTemplate executes a template with the config, without the
+// indentation and blank lines, so fragments can be compared line by line.
+// The test is not named t, which is the parsed templates
+func renderTemplate(test *testing.T, name string, config ConfigTemplateStruct) string {
+	test.Helper()
+
+	var b bytes.Buffer
+	err := t.ExecuteTemplate(&b, name, config)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func TestRenderTemplates(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		content  string
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "http",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]`,
+			contains: []string{
+				"upstream api-site-1 {\nserver api:80;\n}",
+				"listen 80;\nlisten [::]:80;\nserver_name api.example.com;",
+				"location / {\nproxy_pass http://api-site-1;",
+			},
+			excludes: []string{"add_header"},
+		},
+		{
+			name:     "redirect to https",
+			template: "httptoHttps",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				HttpsOnly = true`,
+			contains: []string{
+				"location / {\nreturn 301 https://$server_name$request_uri;\n}",
+			},
+			excludes: []string{"proxy_pass"},
+		},
+		{
+			name:     "https",
+			template: "https",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				CertPath = "/etc/ssl/api.pem"
+				KeyPath = "/etc/ssl/api.key"`,
+			contains: []string{
+				"listen 4343 ssl http2;",
+				"ssl_certificate /etc/ssl/api.pem;\nssl_certificate_key /etc/ssl/api.key;",
+				"location / {\nadd_header Strict-Transport-Security $warden_hsts_api_site_1 always;\nproxy_pass http://api-site-1;",
+			},
+		},
+		{
+			name:     "error pages",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				ErrorPages = {"502" = {Html = "<p>down</p>"}, "404" = {File = "/www/404.html"}}`,
+			contains: []string{
+				"proxy_intercept_errors on;",
+				"error_page 404 /warden-errors/404.html;\nlocation = /warden-errors/404.html {\ninternal;\nalias /www/404.html;\n}",
+				"error_page 502 /warden-errors/502.html;\nlocation = /warden-errors/502.html {\ninternal;\nalias /etc/nginx/conf.d/pages/api-site-1.502.html;\n}",
+			},
+		},
+		{
+			name:     "maintenance",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Maintenance = true
+				MaintenanceAllow = ["10.0.0.0/8"]`,
+			contains: []string{
+				"geo $warden_maintenance_api_site_1 {\ndefault 1;\n10.0.0.0/8 0;\n}",
+				"location / {\nif ($warden_maintenance_api_site_1) {\nreturn 503;\n}",
+			},
+		},
+		{
+			name:     "listen",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Listen = [{Address = "10.0.0.5", Port = 8080}, {Port = 8081, DisableIpv6 = true}]`,
+			contains: []string{
+				"listen 10.0.0.5:8080;\nlisten 8081;\nserver_name api.example.com;",
+			},
+			excludes: []string{"listen 80;"},
+		},
+		{
+			name:     "https listen",
+			template: "https",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				Listen = [{Port = 8443, Ssl = true, Http2 = true}]`,
+			contains: []string{"listen 8443 ssl http2;\nlisten [::]:8443 ssl http2;"},
+			excludes: []string{"4343"},
+		},
+		{
+			name:     "tcp",
+			template: "streams",
+			content: `Type = "tcp"
+				Port = 5432
+				Upstream = [{Address = "db:5432"}]`,
+			contains: []string{
+				"upstream api-site-1  {\nserver db:5432;\n}",
+				"listen 5432;\nlisten [::]:5432;\nproxy_pass api-site-1;",
+			},
+		},
+		{
+			name:     "udp",
+			template: "streams",
+			content: `Type = "udp"
+				Port = 53
+				Upstream = [{Address = "dns:53"}]`,
+			contains: []string{"listen 53 udp;\nlisten [::]:53 udp;"},
+		},
+		{
+			name:     "grpc on its own plain text port",
+			template: "httpBase",
+			content: `Type = "grpc"
+				Domains = ["api.example.com"]
+				Upstream = [{Address = "api:50051"}]
+				Listen = [{Port = 50051, Http2 = true}]`,
+			contains: []string{
+				"listen 50051 http2;",
+				"grpc_pass grpc://api-site-1;",
+				"error_page 502 = @grpc_unavailable;",
+			},
+			excludes: []string{"listen 80"},
+		},
+		{
+			name:     "grpc over https",
+			template: "https",
+			content: `Type = "grpc"
+				Domains = ["api.example.com"]
+				Upstream = [{Address = "api:50051"}]
+				Ssl = true
+				SslSource = "manual"
+				HttpsOnly = true`,
+			contains: []string{
+				"listen 4343 ssl http2;",
+				"grpc_pass grpc://api-site-1;",
+			},
+		},
+		{
+			name:     "fastcgi",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "php:9000"}]
+				Protocol = "fastcgi"
+				Root = "/var/www"`,
+			contains: []string{
+				"root /var/www;\nfastcgi_pass api-site-1;\nfastcgi_index index.php;",
+				"fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;",
+			},
+			excludes: []string{"proxy_pass"},
+		},
+		{
+			name:     "uwsgi",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "app:3031"}]
+				Protocol = "uwsgi"`,
+			contains: []string{"uwsgi_pass uwsgi://api-site-1;\ninclude uwsgi_params;"},
+			excludes: []string{"proxy_pass"},
+		},
+		{
+			name:     "rate limits",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Location = "/"
+				Upstream = [{Address = "api:80"}]
+				RateLimit = {Rate = "10r/s", Burst = 20}
+
+				[[Locations]]
+				Match = "/login"
+				Upstream = [{Address = "api:80"}]
+				RateLimit = {Rate = "5r/m"}
+
+				[[Locations]]
+				Match = "/static"
+				Upstream = [{Address = "api:80"}]`,
+			contains: []string{
+				"location /login {\nlimit_req zone=warden_rate_api_site_1_0;",
+				"location /static {\nlimit_req zone=warden_rate_api_site_1 burst=20;",
+				"location / {\nlimit_req zone=warden_rate_api_site_1 burst=20;",
+			},
+		},
+		{
+			name:     "cors for every origin",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Cors = {AllowOrigins = ["*"]}`,
+			contains: []string{"map $http_origin $warden_cors_api_site_1 {\ndefault \"*\";\n}"},
+			excludes: []string{"Access-Control-Allow-Credentials"},
+		},
+		{
+			name:     "cors with credentials",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Cors = {AllowOrigins = ["https://app.example.com"], AllowCredentials = true}`,
+			contains: []string{
+				"map $http_origin $warden_cors_api_site_1 {\ndefault \"\";",
+				`"~*^https://app\\.example\\.com$" $http_origin;`,
+				"add_header Access-Control-Allow-Credentials true always;",
+			},
+		},
+		{
+			name:     "hsts with cors",
+			template: "https",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				Cors = {AllowOrigins = ["https://app.example.com"]}`,
+			contains: []string{
+				"add_header Strict-Transport-Security \"max-age=15768000\" always;",
+				"add_header Access-Control-Allow-Origin $warden_cors_api_site_1 always;\nadd_header Vary Origin always;\nadd_header Strict-Transport-Security $warden_hsts_api_site_1 always;\nproxy_pass http://api-site-1;",
+			},
+		},
+		{
+			name:     "hsts map",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				SecurityHeaders = {Preset = "basic", Hsts = {MaxAge = 31536000}}`,
+			contains: []string{
+				"map $https $warden_hsts_api_site_1 {\ndefault \"\";\non \"max-age=31536000\";\n}",
+				"location / {\nadd_header Strict-Transport-Security $warden_hsts_api_site_1 always;\nadd_header X-Frame-Options \"SAMEORIGIN\" always;",
+			},
+		},
+		{
+			name:     "hsts disabled",
+			template: "https",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				SecurityHeaders = {Hsts = {Disable = true}}`,
+			excludes: []string{"Strict-Transport-Security"},
+		},
+		{
+			name:     "cache",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Cache = {Valid = {"200" = "10m"}, StatusHeader = true}`,
+			contains: []string{
+				"proxy_cache warden_cache_site_api;",
+				"proxy_cache_valid 200 10m;",
+				"add_header X-Cache-Status $upstream_cache_status always;",
+			},
+		},
+		{
+			name:     "split",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				[Split]
+				Groups = [
+					{Name = "stable", Weight = 91.8, Upstream = [{Address = "stable:80"}]},
+					{Name = "canary", Weight = 8.2, Upstream = [{Address = "canary:80"}]},
+				]`,
+			contains: []string{
+				"upstream api-site-1-stable {\nserver stable:80;\n}",
+				"split_clients \"$request_id\" $warden_split_api_site_1 {\n91.8% api-site-1-stable;\n* api-site-1-canary;\n}",
+				"proxy_pass http://$warden_split_api_site_1;",
+			},
+		},
+		{
+			name:     "mirror",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Mirror = {Upstream = [{Address = "shadow:80"}], Percent = 10.0}`,
+			contains: []string{
+				"upstream api-site-1.mirror {\nserver shadow:80;\n}",
+				"split_clients \"$request_id\" $warden_mirror_api_site_1 {\n10% 1;\n* \"\";\n}",
+				"location = /_warden_mirror/api-site-1 {\ninternal;",
+				"mirror /_warden_mirror/api-site-1;",
+			},
+		},
+		{
+			name:     "sticky header",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api-1:80"}, {Address = "api-2:80"}]
+				Sticky = {Header = "X-Session"}`,
+			contains: []string{"upstream api-site-1 {\nserver api-1:80;\nserver api-2:80;\nhash $warden_sticky_api_site_1 consistent;\n}"},
+			excludes: []string{"Set-Cookie"},
+		},
+		{
+			name:     "split with sticky sessions",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Sticky = {Cookie = "route"}
+				[Split]
+				Groups = [
+					{Name = "a", Weight = 90, Upstream = [{Address = "a:80"}]},
+					{Name = "b", Weight = 10, Upstream = [{Address = "b:80"}]},
+				]`,
+			contains: []string{
+				"map $cookie_route $warden_sticky_api_site_1 {",
+				"upstream api-site-1-a {\nserver a:80;\nhash $warden_sticky_api_site_1 consistent;\n}",
+				"split_clients \"$warden_sticky_api_site_1\" $warden_split_api_site_1 {\n90% api-site-1-a;\n* api-site-1-b;\n}",
+				"add_header Set-Cookie $warden_sticky_api_site_1_cookie always;",
+			},
+		},
+		{
+			name:     "fastcgi retries",
+			template: "httpBase",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "php:9000"}]
+				Protocol = "fastcgi"
+				Root = "/var/www"
+				Timeouts = {Read = "30s"}
+				Retry = {Conditions = ["error", "http_503"], Tries = 2}`,
+			contains: []string{
+				"fastcgi_read_timeout 30s;",
+				"fastcgi_next_upstream error http_503;\nfastcgi_next_upstream_tries 2;",
+			},
+			excludes: []string{"proxy_read_timeout", "proxy_next_upstream"},
+		},
+		{
+			name:     "client auth",
+			template: "https",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				HttpsOnly = true
+				ClientAuth = {CaFile = "/etc/ssl/ca.pem", Verify = "optional"}`,
+			contains: []string{
+				"ssl_client_certificate /etc/ssl/ca.pem;\nssl_verify_client optional;",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := renderTemplate(t, test.template, testConfig(t, test.content))
+
+			for _, fragment := range test.contains {
+				if !strings.Contains(output, fragment) {
+					t.Errorf("expected %q in:\n%s", fragment, output)
+				}
+			}
+
+			for _, fragment := range test.excludes {
+				if strings.Contains(output, fragment) {
+					t.Errorf("did not expect %q in:\n%s", fragment, output)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderProxyProtocol(t *testing.T) {
+	defer withSettings(Settings{
+		ProxyProtocol: true,
+		RealIpFrom:    []string{"10.0.0.1"},
+	})()
+
+	tests := []struct {
+		name     string
+		content  string
+		contains []string
+	}{
+		{
+			name: "internal https port",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"`,
+			contains: []string{"listen 4343 ssl http2 proxy_protocol;"},
+		},
+		{
+			name: "own https port",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				Listen = [{Port = 8443, Ssl = true}]`,
+			contains: []string{"listen 8443 ssl;"},
+		},
+		{
+			name: "own https port with the proxy protocol",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				Listen = [{Port = 8443, Ssl = true, ProxyProtocol = true}]`,
+			contains: []string{"listen 8443 ssl proxy_protocol;"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := renderTemplate(t, "https", testConfig(t, test.content))
+
+			for _, fragment := range test.contains {
+				if !strings.Contains(output, fragment) {
+					t.Errorf("expected %q in:\n%s", fragment, output)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderWithoutMirror(t *testing.T) {
+	content := `Domains = ["api.example.com"]
+		Upstream = [{Address = "api:80"}]
+		Mirror = {Upstream = [{Address = "shadow:80"}]}`
+
+	unreachableMirrorsMu.Lock()
+	unreachableMirrors["api-site-1.mirror"] = true
+	unreachableMirrorsMu.Unlock()
+	defer func() {
+		unreachableMirrorsMu.Lock()
+		delete(unreachableMirrors, "api-site-1.mirror")
+		unreachableMirrorsMu.Unlock()
+	}()
+
+	config := testConfig(t, content)
+	removeUnreachableMirrors(&config)
+	output := renderTemplate(t, "httpBase", config)
+	if strings.Contains(output, "mirror") {
+		t.Errorf("did not expect an unreachable mirror in:\n%s", output)
+	}
+
+	// warden switch keeps the mirrors of the rendered config
+	config = testConfig(t, content)
+	removeMirrorsNotIn(&config, []byte(output))
+	if output != renderTemplate(t, "httpBase", config) {
+		t.Error("expected the mirror to stay out of the config")
+	}
+
+	rendered := renderTemplate(t, "httpBase", testConfig(t, content))
+	config = testConfig(t, content)
+	removeMirrorsNotIn(&config, []byte(rendered))
+	if rendered != renderTemplate(t, "httpBase", config) {
+		t.Error("expected the mirror to stay in the config")
+	}
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"fmt"
+)
+
+var nextUpstreamConditions = map[string]bool{
+	"error": true, "timeout": true, "invalid_header": true,
+	"http_500": true, "http_502": true, "http_503": true, "http_504": true,
+	"http_403": true, "http_404": true, "http_429": true,
+	"non_idempotent": true, "off": true,
+}
+
+// fastcgi_next_upstream and uwsgi_next_upstream have no
+// http_502 and http_504 conditions
+var noGatewayConditions = map[string]bool{
+	"http_502": true, "http_504": true,
+}
+
+// NextUpstream are the arguments of the next_upstream directive.
+// Empty if the nginx default should be used
+func (r Retry) NextUpstream() []string {
+	conditions := r.Conditions
+	if len(conditions) == 0 && r.NonIdempotent {
+		conditions = []string{"error", "timeout"}
+	}
+
+	if r.NonIdempotent {
+		conditions = append(append([]string{}, conditions...), "non_idempotent")
+	}
+
+	return conditions
+}
+
+func validateTimeouts(timeouts *Timeouts) error {
+	if timeouts == nil {
+		return nil
+	}
+
+	for _, duration := range []string{timeouts.Connect, timeouts.Send, timeouts.Read} {
+		if duration != "" && !nginxTime.MatchString(duration) {
+			return fmt.Errorf("invalid timeout %q", duration)
+		}
+	}
+
+	return nil
+}
+
+func validateRetry(retry *Retry, protocol string) error {
+	if retry == nil {
+		return nil
+	}
+
+	for _, condition := range retry.Conditions {
+		if !nextUpstreamConditions[condition] {
+			return fmt.Errorf("unknown retry condition %q", condition)
+		}
+
+		if noGatewayConditions[condition] && (protocol == "fastcgi" || protocol == "uwsgi") {
+			return fmt.Errorf("the retry condition %s can not be used with %s", condition, protocol)
+		}
+
+		if condition == "off" && (len(retry.Conditions) > 1 || retry.NonIdempotent) {
+			return fmt.Errorf("the retry condition off can not be used with other conditions")
+		}
+	}
+
+	if retry.Timeout != "" && !nginxTime.MatchString(retry.Timeout) {
+		return fmt.Errorf("invalid retry timeout %q", retry.Timeout)
+	}
+
+	return nil
+}
+
+// validateTimeoutOptions rejects Options that set the same directives
+// as the Timeouts or Retry of the location, since nginx fails on
+// duplicate directives
+func validateTimeoutOptions(location LocationTemplateStruct) error {
+	var directives []string
+
+	if timeouts := location.Timeouts; timeouts != nil {
+		if timeouts.Connect != "" {
+			directives = append(directives, "_connect_timeout")
+		}
+		if timeouts.Send != "" {
+			directives = append(directives, "_send_timeout")
+		}
+		if timeouts.Read != "" {
+			directives = append(directives, "_read_timeout")
+		}
+	}
+
+	if retry := location.Retry; retry != nil {
+		if len(retry.NextUpstream()) > 0 {
+			directives = append(directives, "_next_upstream")
+		}
+		if retry.Tries != 0 {
+			directives = append(directives, "_next_upstream_tries")
+		}
+		if retry.Timeout != "" {
+			directives = append(directives, "_next_upstream_timeout")
+		}
+	}
+
+	for _, directive := range directives {
+		directive = location.DirectivePrefix() + directive
+		if _, ok := location.Options[directive]; ok {
+			return fmt.Errorf(
+				"%s can not be in the Options of location %q with Timeouts or Retry",
+				directive,
+				location.Match,
+			)
+		}
+	}
+
+	return nil
+}
@@ -1,9 +1,35 @@
 package cmd
 
+import (
+	"fmt"
+	"strings"
+)
+
 type Options map[string]string
 
 type Location struct {
 	Match           string
+	Protocol        string // Default is the Protocol of the service
+	Root            string // Document root for fastcgi and uwsgi
+	Index           string // fastcgi_index
+	RateLimit       *RateLimit
+	BasicAuth       *BasicAuth
+	Access          *AccessControl
+	Auth            *ForwardAuth
+	Cors            *Cors
+	SecurityHeaders *SecurityHeaders
+	Cache           *Cache
+	Compression     *Compression
+	HeaderRules     *HeaderRules
+	StripPrefix     string // removed from the path sent to the upstream
+	AddPrefix       string // added to the path sent to the upstream
+	Rewrites        []Rewrite
+	Split           *Split // instead of Upstream
+	Sticky          *Sticky
+	Mirror          *Mirror
+	Timeouts        *Timeouts
+	Retry           *Retry
+	UpstreamTls     *UpstreamTls
 	Options         Options
 	Upstream        []UpstreamServer
 	UpstreamOptions Options
@@ -14,28 +40,385 @@ type UpstreamServer struct {
 	Parameters []string
 }
 
+// ErrorPage is the page shown for a status code.
+// Only one of File or Html should be set
+type ErrorPage struct {
+	File string // path to an existing html file
+	Html string // inline html, written to a file by warden
+}
+
+// RateLimit limits the rate of requests with the same Key
+type RateLimit struct {
+	Key     string // Default $binary_remote_addr
+	Rate    string // e.g. 10r/s or 30r/m
+	Burst   uint
+	NoDelay bool
+	Status  uint // Default 503
+}
+
+// BasicAuth protects a location with usernames and passwords
+type BasicAuth struct {
+	Realm string // Default "Restricted"
+	Users []BasicAuthUser
+}
+
+// BasicAuthUser needs exactly one of Hash or PasswordFile
+type BasicAuthUser struct {
+	Name         string
+	Hash         string // SHA-512 crypt, e.g. from openssl passwd -6
+	PasswordFile string // contains the plaintext password. Hashed by warden
+}
+
+// AccessControl allows or denies clients by IP.
+// Denied addresses are checked first. If any address is allowed,
+// every other address is denied
+type AccessControl struct {
+	Allow []string // IPs, CIDRs, "all" or names of shared lists
+	Deny  []string
+}
+
+// ForwardAuth checks every request with a subrequest to an
+// external service, such as oauth2-proxy
+type ForwardAuth struct {
+	Url             string   // e.g. http://oauth2-proxy:4180/oauth2/auth
+	SignIn          string   // Where to redirect to if the Url returns 401
+	ResponseHeaders []string // Copied from the auth response to the upstream request
+}
+
+// SignInRedirect is the SignIn url with the original url added as "rd"
+func (a ForwardAuth) SignInRedirect() string {
+	separator := "?"
+	if strings.Contains(a.SignIn, "?") {
+		separator = "&"
+	}
+
+	return a.SignIn + separator + "rd=$scheme://$http_host$request_uri"
+}
+
+// Cors is the cross-origin resource sharing policy of a location
+type Cors struct {
+	AllowOrigins     []string // e.g. https://example.com, https://*.example.com or *
+	AllowMethods     []string // Default GET, HEAD, POST, PUT, PATCH, DELETE
+	AllowHeaders     []string // Default is the headers asked for by the preflight
+	ExposeHeaders    []string
+	AllowCredentials bool
+	MaxAge           uint // how many seconds a preflight response can be cached
+}
+
+// SecurityHeaders are the security related response headers.
+// Empty fields use the value from the preset, "off" removes the header
+type SecurityHeaders struct {
+	Preset                string // basic or strict
+	Hsts                  *Hsts
+	ContentSecurityPolicy string
+	FrameOptions          string
+	ContentTypeOptions    string
+	ReferrerPolicy        string
+	PermissionsPolicy     string
+}
+
+// Hsts configures the Strict-Transport-Security header
+type Hsts struct {
+	Disable           bool
+	MaxAge            uint // Default 15768000
+	IncludeSubDomains bool
+	Preload           bool
+}
+
+// Cache configures caching of upstream responses.
+// KeysSize, MaxSize and Inactive are only read from the service and
+// apply to the cache zone shared by all its locations
+type Cache struct {
+	Disable          bool              // turn off a cache set on the service
+	Key              string            // Default $scheme$request_method$host$request_uri
+	Valid            map[string]string // statuses, e.g. "200 302" or "any", to how long they are cached
+	Bypass           []string          // if any is not empty or "0", the cache is not used
+	UseStale         []string          // e.g. error, timeout, updating, http_500
+	BackgroundUpdate bool
+	Lock             bool
+	MinUses          uint
+	StatusHeader     bool   // add an X-Cache-Status header to responses
+	KeysSize         string // Default 10m
+	MaxSize          string // Default 1g
+	Inactive         string // Default 60m
+}
+
+// Compression overrides the gzip settings of nginx.conf.
+// Brotli is only used if nginx has the module
+type Compression struct {
+	Disable     bool
+	Level       uint // 1 to 9
+	MinLength   uint
+	Types       []string // text/html is always compressed
+	Brotli      bool
+	BrotliLevel uint // 1 to 11
+}
+
+// HeaderRules change the headers of requests and responses
+type HeaderRules struct {
+	Request  []HeaderRule // sent to the upstream
+	Response []HeaderRule // sent to the client
+}
+
+// HeaderRule is a single header change
+type HeaderRule struct {
+	Action string // set, add or remove. add is only for responses
+	Name   string
+	Value  string
+	Always bool // also for error responses. Only for responses
+}
+
+// Rewrite changes the path of requests with the rewrite directive.
+// The rewrites run before the path prefixes are changed
+type Rewrite struct {
+	Regex       string
+	Replacement string
+	Flag        string // last, break, redirect or permanent
+}
+
+// Split sends a percentage of the requests to each upstream group
+type Split struct {
+	Key    string // what requests are split by. Default $request_id
+	Groups []UpstreamGroup
+}
+
+// UpstreamGroup is a named set of upstream servers
+type UpstreamGroup struct {
+	Name            string
+	Weight          Percentage // of requests
+	Upstream        []UpstreamServer
+	UpstreamOptions Options
+}
+
+// Sticky sends the requests of a client to the same upstream server.
+// Servers are chosen by consistent hashing of their address, so clients
+// keep their server when the config is regenerated
+type Sticky struct {
+	Cookie string // name of the routing cookie set by warden
+	MaxAge uint   // of the cookie, in seconds. Default is a session cookie
+	Secure bool   // only send the cookie over HTTPS
+	Header string // use a header sent by the client instead of a cookie
+}
+
+// BlueGreen has several sets of upstream servers for the main Location.
+// Only the active color gets traffic. It is changed with `warden switch`
+type BlueGreen struct {
+	Active string // used until `warden switch` is run
+	Colors map[string]UpstreamSet
+}
+
+// UpstreamSet is a set of upstream servers and their options
+type UpstreamSet struct {
+	Upstream        []UpstreamServer
+	UpstreamOptions Options
+}
+
+// Mirror sends a copy of requests to a shadow upstream.
+// Its responses are ignored
+type Mirror struct {
+	Disable         bool // turn off a mirror set on the service
+	Upstream        []UpstreamServer
+	UpstreamOptions Options
+	Percent         Percentage // of requests to mirror. Default 100
+	NoRequestBody   bool       // do not send request bodies to the mirror
+	Timeout         string     // for connecting and each read and write. Default 5s
+}
+
+// AccessLog is a separate access log for a service
+type AccessLog struct {
+	Path       string     // in /var/log/nginx/services. Default /var/log/nginx/services/<file>.<service>.log
+	Format     string     // json or the name of a log format. Default json
+	Buffer     string     // size of the write buffer, e.g. 32k
+	Flush      string     // how long lines can stay in the buffer, e.g. 5s
+	Sample     Percentage // of requests to log. Default 100
+	ErrorsOnly bool       // only log 4xx and 5xx responses
+}
+
+// Timeouts are for the connection to the upstream servers.
+// Read and Send are the longest time between two reads or writes
+type Timeouts struct {
+	Connect string // e.g. 5s
+	Send    string
+	Read    string
+}
+
+// Retry is when a request is passed to the next upstream server
+type Retry struct {
+	Conditions    []string // e.g. error, timeout, http_502 or off. Default error and timeout
+	NonIdempotent bool     // also retry POST, LOCK and PATCH requests
+	Tries         uint     // at most, including the first. Default is no limit
+	Timeout       string   // how long to keep trying. Default is no limit
+}
+
+// ClientAuth is for verifying the TLS certificates of clients
+type ClientAuth struct {
+	CaFile        string // PEM bundle of the CAs that sign client certificates
+	Verify        string // required or optional. Default required
+	Depth         uint   // of the client certificate chain. Default 1
+	CrlFile       string // PEM certificate revocation lists
+	SubjectHeader string // passed to the upstream. Default X-Client-Subject
+	VerifyHeader  string // passed to the upstream. Default X-Client-Verify
+}
+
+// UpstreamTls is for TLS connections to the upstream servers
+type UpstreamTls struct {
+	Disable    bool   // for a location, when the service has UpstreamTls
+	Verify     bool   // check the certificates of the servers
+	CaFile     string // PEM bundle of the CAs trusted to Verify
+	Depth      uint   // of the server certificate chain. Default 1
+	ServerName string // to verify and send with SNI. Default is the requested host
+	DisableSni bool   // do not send the ServerName with SNI
+	CertFile   string // client certificate, if the servers ask for one
+	KeyFile    string
+}
+
+// ProxyProtocol is for TCP services
+type ProxyProtocol struct {
+	Accept bool // expect the PROXY protocol header from clients
+	Send   bool // send the PROXY protocol header to the upstream servers
+}
+
+// Listen is an address nginx should listen on for a HTTP service
+type Listen struct {
+	Address     string // Default is all interfaces
+	Port        uint   // Default 80, or 4343 if Ssl
+	Ssl         bool   // Used by the HTTPS server instead of the HTTP one
+	Http2       bool
+	DisableIpv6 bool // Do not also listen on [::] when Address is empty
+
+	// Expect the PROXY protocol header. It is on for every service using
+	// the same address and port, so all of them should set it
+	ProxyProtocol bool
+}
+
 type ServiceConfig struct {
-	Type            string // HTTP, TCP, SNI, default HTTP
+	Type            string // HTTP, GRPC, TCP, SNI, default HTTP
 	Upstream        []UpstreamServer
 	UpstreamOptions Options
 
 	// Parameters for HTTP proxy type
-	Domains         []string // required for this type
-	Location        string   // Default "/"
-	LocationOptions Options
-	Locations       []Location
-	Ssl             bool
-	SslSource       string // letsencrypt, proxy, manual
-	HttpsOnly       bool
-	CertPath        string
-	KeyPath         string
+	Domains          []string // required for this type
+	Location         string   // Default "/"
+	LocationOptions  Options
+	StripPrefix      string     // for the main Location
+	AddPrefix        string     // for the main Location
+	Rewrites         []Rewrite  // for the main Location
+	Split            *Split     // for the main Location, instead of Upstream
+	Sticky           *Sticky    // for the main Location
+	BlueGreen        *BlueGreen // for the main Location, instead of Upstream
+	Locations        []Location
+	Protocol         string // http, https, fastcgi, uwsgi, grpc or grpcs. Default http
+	Root             string // Document root on the upstream for fastcgi and uwsgi
+	Index            string // fastcgi_index, default index.php
+	Ssl              bool
+	SslSource        string // letsencrypt, proxy, manual
+	HttpsOnly        bool
+	ClientAuth       *ClientAuth // needs Ssl and HttpsOnly
+	CertPath         string
+	KeyPath          string
+	Listen           []Listen             // Default port 80, and 4343 behind the 443 SNI router
+	Default          bool                 // Fallback for requests with an unknown host
+	ErrorPages       map[string]ErrorPage // keyed by status code e.g. "502"
+	Maintenance      bool                 // return 503 for every proxied location
+	RateLimit        *RateLimit           // Default for all locations
+	BasicAuth        *BasicAuth           // Default for all locations
+	Access           *AccessControl       // Default for all locations, also used for TCP/UDP
+	Auth             *ForwardAuth         // Default for all locations
+	Cors             *Cors                // Default for all locations
+	SecurityHeaders  *SecurityHeaders     // Default for all locations
+	Cache            *Cache               // Default for all locations
+	Compression      *Compression         // Default for all locations
+	HeaderRules      *HeaderRules         // Added before the rules of each location
+	Mirror           *Mirror              // Default for all locations
+	AccessLog        *AccessLog
+	Timeouts         *Timeouts    // Default for all locations
+	Retry            *Retry       // Default for all locations
+	UpstreamTls      *UpstreamTls // Default for all locations, also used for TCP
+	MaintenanceAllow []string     // IPs or CIDRs that bypass maintenance
 
 	// parameters for TCP/UDP proxy type
 	Port          uint // required for this type
 	ServerOptions Options
+	ProxyProtocol *ProxyProtocol // TCP only
+}
+
+// LocationTemplateStruct is a single proxied location.
+// The main Location of a service is also represented with this
+type LocationTemplateStruct struct {
+	Location
+	Unique      string // name of the upstream block
+	Variable    string // Unique of the service, safe for nginx variable names
+	Maintenance bool
+	Ssl         bool // of the service
+
+	HtpasswdPath   string            // file for the users of the BasicAuth
+	RateLimitZone  string            // shared by the locations with the same RateLimit
+	ErrorPageFiles map[string]string // of the service
+	CacheZone      string            // keys zone of the service cache
+	MirrorUpstream string            // name of the upstream block of the Mirror
+	ClientAuth     *ClientAuth       // of the service
+}
+
+// SetHeader is the directive that sets a header on the request
+// to the upstream, based on the protocol of the location
+func (l LocationTemplateStruct) SetHeader(name, value string) string {
+	switch l.Protocol {
+	case "fastcgi", "uwsgi":
+		param := "HTTP_" + strings.ToUpper(nginxVariableName(name))
+		return fmt.Sprintf("%s_param %s %s;", l.Protocol, param, value)
+	case "grpc", "grpcs":
+		return fmt.Sprintf("grpc_set_header %s %s;", name, value)
+	default:
+		return fmt.Sprintf("proxy_set_header %s %s;", name, value)
+	}
+}
+
+// DirectivePrefix is the prefix of the directives for the
+// module that passes requests to the upstream
+func (l LocationTemplateStruct) DirectivePrefix() string {
+	switch l.Protocol {
+	case "fastcgi", "uwsgi":
+		return l.Protocol
+	case "grpc", "grpcs":
+		return "grpc"
+	default:
+		return "proxy"
+	}
+}
+
+// IsGrpc is true if requests to the location are passed with grpc_pass
+func (l LocationTemplateStruct) IsGrpc() bool {
+	return l.Protocol == "grpc" || l.Protocol == "grpcs"
 }
 
 type ConfigTemplateStruct struct {
 	ServiceConfig
-	Unique   string
+	Unique         string
+	Variable       string // Unique, safe to use in nginx variable names
+	AllLocations   []LocationTemplateStruct
+	Grpc           bool     // true if any location uses grpc
+	HttpListen     []string // arguments of the listen directives
+	HttpsListen    []string
+	StreamListen   []string
+	SniUpstream    string            // where 443 should send the domains, if not 4343
+	ErrorPageFiles map[string]string // status code to the file served
+	CacheZone      string            // keys zone of the cache shared by the locations
+	CachePath      string
+	ActiveColor    string // of the BlueGreen upstreams
+
+	// Addresses trusted to send the PROXY protocol to the listeners
+	HttpRealIpFrom  []string
+	HttpsRealIpFrom []string
+}
+
+// DefaultServerTemplateStruct is for the server that catches requests
+// that do not match any configured domain
+type DefaultServerTemplateStruct struct {
+	HttpListen  []string
+	HttpsListen []string
+	RealIpFrom  []string // trusted to send the PROXY protocol
+	CertPath    string
+	KeyPath     string
+	Page        string // file name of the page to show, or empty for 444
+	PageDir     string
 }
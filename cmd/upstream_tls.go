@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UpstreamTlsDirectives are the directives for the TLS connections to
+// the upstream servers. By default, the requested host is used for SNI
+// and to verify the certificates
+func (l LocationTemplateStruct) UpstreamTlsDirectives() []string {
+	return upstreamTlsDirectives(l.DirectivePrefix(), l.UpstreamTls, "$host")
+}
+
+// StreamTlsDirectives are the directives for the TLS connections
+// to the upstream servers of TCP services
+func (c ConfigTemplateStruct) StreamTlsDirectives() []string {
+	if c.UpstreamTls == nil || c.UpstreamTls.Disable {
+		return nil
+	}
+
+	return append(
+		[]string{"proxy_ssl on;"},
+		upstreamTlsDirectives("proxy", c.UpstreamTls, "")...,
+	)
+}
+
+func upstreamTlsDirectives(prefix string, upstreamTls *UpstreamTls, defaultName string) []string {
+	if upstreamTls == nil {
+		return nil
+	}
+
+	var directives []string
+	add := func(name, value string) {
+		directives = append(
+			directives,
+			fmt.Sprintf("%s_ssl_%s %s;", prefix, name, value),
+		)
+	}
+
+	name := upstreamTls.ServerName
+	if name == "" {
+		name = defaultName
+	}
+
+	if name != "" {
+		add("name", name)
+		if !upstreamTls.DisableSni {
+			add("server_name", "on")
+		}
+	}
+
+	if upstreamTls.Verify {
+		add("verify", "on")
+		add("trusted_certificate", upstreamTls.CaFile)
+		if upstreamTls.Depth > 0 {
+			add("verify_depth", strconv.FormatUint(uint64(upstreamTls.Depth), 10))
+		}
+	}
+
+	if upstreamTls.CertFile != "" {
+		add("certificate", upstreamTls.CertFile)
+		add("certificate_key", upstreamTls.KeyFile)
+	}
+
+	return directives
+}
+
+func validateUpstreamTls(upstreamTls *UpstreamTls, protocol string) error {
+	if upstreamTls == nil || upstreamTls.Disable {
+		return nil
+	}
+
+	switch protocol {
+	case "https", "grpcs", "tcp", "stream":
+	default:
+		return fmt.Errorf("TLS to the upstream is not supported for %s", protocol)
+	}
+
+	if strings.ContainsAny(upstreamTls.ServerName, " \t;{}'\"") {
+		return fmt.Errorf("invalid upstream server name %q", upstreamTls.ServerName)
+	}
+
+	if upstreamTls.Verify {
+		if upstreamTls.CaFile == "" {
+			return fmt.Errorf("a CaFile is needed to verify the upstream servers")
+		}
+
+		err := validateCaFile(upstreamTls.CaFile)
+		if err != nil {
+			return err
+		}
+	} else if upstreamTls.CaFile != "" || upstreamTls.Depth > 0 {
+		return fmt.Errorf("CaFile and Depth are only used with Verify = true")
+	}
+
+	if (upstreamTls.CertFile == "") != (upstreamTls.KeyFile == "") {
+		return fmt.Errorf("the upstream client certificate needs both CertFile and KeyFile")
+	}
+
+	if upstreamTls.CertFile != "" {
+		_, err := tls.LoadX509KeyPair(upstreamTls.CertFile, upstreamTls.KeyFile)
+		if err != nil {
+			return fmt.Errorf("invalid upstream client certificate: %s", err)
+		}
+	}
+
+	return nil
+}
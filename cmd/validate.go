@@ -0,0 +1,341 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// validateConfig checks the parts of a service config that nginx
+// would otherwise only complain about when reloading
+func validateConfig(config ConfigTemplateStruct) error {
+	switch strings.ToLower(config.Type) {
+	case "tcp", "udp", "stream":
+		if config.Port == 0 {
+			return fmt.Errorf("a port is required for %s services", config.Type)
+		}
+
+		err := validateUpstreamTls(config.UpstreamTls, strings.ToLower(config.Type))
+		if err != nil {
+			return err
+		}
+
+		upstreamTls := config.UpstreamTls
+		if upstreamTls != nil && upstreamTls.Verify && upstreamTls.ServerName == "" {
+			return fmt.Errorf("a ServerName is needed to verify the upstream servers")
+		}
+	}
+
+	err := validateListen(config.Listen)
+	if err != nil {
+		return err
+	}
+
+	err = validateGrpcListen(config)
+	if err != nil {
+		return err
+	}
+
+	err = validateClientAuth(config)
+	if err != nil {
+		return err
+	}
+
+	err = validateProxyProtocol(config)
+	if err != nil {
+		return err
+	}
+
+	err = validateBlueGreen(config)
+	if err != nil {
+		return err
+	}
+
+	err = validateAccessLog(config)
+	if err != nil {
+		return err
+	}
+
+	for _, location := range config.AllLocations {
+		switch location.Protocol {
+		case "http", "https", "grpc", "grpcs", "uwsgi":
+		case "fastcgi":
+			if location.Root == "" {
+				return fmt.Errorf(
+					"a Root is required for the fastcgi location %q",
+					location.Match,
+				)
+			}
+		default:
+			return fmt.Errorf(
+				"unknown protocol %q for location %q",
+				location.Protocol,
+				location.Match,
+			)
+		}
+	}
+
+	for _, location := range config.AllLocations {
+		err = validateRateLimit(location.RateLimit)
+		if err != nil {
+			return err
+		}
+
+		err = validateBasicAuth(location.BasicAuth)
+		if err != nil {
+			return err
+		}
+
+		err = validateAccessControl(location.Access)
+		if err != nil {
+			return err
+		}
+
+		err = validateForwardAuth(location.Auth)
+		if err != nil {
+			return err
+		}
+
+		err = validateCors(location.Cors)
+		if err != nil {
+			return err
+		}
+
+		err = validateSecurityHeaders(location.SecurityHeaders)
+		if err != nil {
+			return err
+		}
+
+		err = validateCache(location.Cache, location.Protocol)
+		if err != nil {
+			return err
+		}
+
+		err = validateCompression(location.Compression)
+		if err != nil {
+			return err
+		}
+
+		err = validateHeaderRules(location.HeaderRules)
+		if err != nil {
+			return err
+		}
+
+		err = validateRewrites(location)
+		if err != nil {
+			return err
+		}
+
+		if location.Split != nil && len(location.Upstream) > 0 {
+			return fmt.Errorf(
+				"location %q can not have both an Upstream and a Split",
+				location.Match,
+			)
+		}
+
+		err = validateSplit(location.Split)
+		if err != nil {
+			return err
+		}
+
+		err = validateSticky(location)
+		if err != nil {
+			return err
+		}
+
+		err = validateMirror(location)
+		if err != nil {
+			return err
+		}
+
+		err = validateUpstreamTls(location.UpstreamTls, location.Protocol)
+		if err != nil {
+			return fmt.Errorf("location %q: %s", location.Match, err)
+		}
+
+		err = validateTimeouts(location.Timeouts)
+		if err != nil {
+			return err
+		}
+
+		err = validateRetry(location.Retry, location.Protocol)
+		if err != nil {
+			return err
+		}
+
+		err = validateTimeoutOptions(location)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = validateAccessControl(config.Access)
+	if err != nil {
+		return err
+	}
+
+	for code, page := range config.ErrorPages {
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 300 || status > 599 {
+			return fmt.Errorf("invalid error page status code %q", code)
+		}
+
+		if (page.File == "") == (page.Html == "") {
+			return fmt.Errorf(
+				"error page %q must have exactly one of File or Html",
+				code,
+			)
+		}
+	}
+
+	for _, address := range config.MaintenanceAllow {
+		err := validateAddress(address)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateAddress checks that a string is a valid IP or CIDR
+func validateAddress(address string) error {
+	if strings.Contains(address, "/") {
+		_, _, err := net.ParseCIDR(address)
+		return err
+	}
+
+	if net.ParseIP(address) == nil {
+		return fmt.Errorf("invalid IP address %q", address)
+	}
+
+	return nil
+}
+
+var (
+	headerName      = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+	requestRate     = regexp.MustCompile(`^[0-9]+r/[sm]$`)
+	nginxSize       = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+	logFormatName   = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+	workerProcesses = regexp.MustCompile(`^([1-9][0-9]*|auto)$`)
+)
+
+// validateSettings checks the settings used to generate nginx.conf
+func validateSettings(s Settings) error {
+	if !workerProcesses.MatchString(s.WorkerProcesses) {
+		return fmt.Errorf("invalid worker processes %q", s.WorkerProcesses)
+	}
+
+	if s.WorkerConnections < 1 {
+		return fmt.Errorf("invalid worker connections %d", s.WorkerConnections)
+	}
+
+	if s.GzipMinLength < 0 {
+		return fmt.Errorf("invalid gzip min length %d", s.GzipMinLength)
+	}
+
+	if !nginxSize.MatchString(s.ClientMaxBodySize) {
+		return fmt.Errorf("invalid client max body size %q", s.ClientMaxBodySize)
+	}
+
+	if strings.TrimSpace(s.Resolver) == "" {
+		return fmt.Errorf("a resolver is required")
+	}
+
+	for name := range s.LogFormats {
+		if !logFormatName.MatchString(name) {
+			return fmt.Errorf("invalid log format name %q", name)
+		}
+
+		if name == "warden_json" {
+			return fmt.Errorf("the warden_json log format is defined by warden")
+		}
+	}
+
+	_, ok := s.LogFormats[s.AccessLogFormat]
+	if !ok && s.AccessLogFormat != "warden_json" {
+		return fmt.Errorf("unknown access log format %q", s.AccessLogFormat)
+	}
+
+	for _, address := range s.RealIpFrom {
+		err := validateAddress(address)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.ProxyProtocol && len(s.RealIpFrom) == 0 {
+		return fmt.Errorf(
+			"REAL_IP_FROM is needed to trust the addresses sending the PROXY protocol",
+		)
+	}
+
+	for name, list := range s.AccessLists {
+		for _, address := range list {
+			err := validateAddress(address)
+			if err != nil {
+				return fmt.Errorf("invalid address in access list %q: %s", name, err)
+			}
+		}
+	}
+
+	for _, snippet := range []string{s.HttpSnippet, s.StreamSnippet} {
+		if strings.Count(snippet, "{") != strings.Count(snippet, "}") {
+			return fmt.Errorf("unbalanced braces in snippet %q", snippet)
+		}
+	}
+
+	return nil
+}
+
+func validateRateLimit(rateLimit *RateLimit) error {
+	if rateLimit == nil {
+		return nil
+	}
+
+	if !requestRate.MatchString(rateLimit.Rate) {
+		return fmt.Errorf("invalid rate %q, use e.g 10r/s", rateLimit.Rate)
+	}
+
+	if rateLimit.Status != 0 && (rateLimit.Status < 400 || rateLimit.Status > 599) {
+		return fmt.Errorf("invalid rate limit status %d", rateLimit.Status)
+	}
+
+	return nil
+}
+
+func validateForwardAuth(auth *ForwardAuth) error {
+	if auth == nil {
+		return nil
+	}
+
+	if auth.Url == "" {
+		return fmt.Errorf("a Url is required for auth")
+	}
+
+	for _, rawurl := range []string{auth.Url, auth.SignIn} {
+		if rawurl == "" {
+			continue
+		}
+
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return err
+		}
+
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("auth url %q must start with http:// or https://", rawurl)
+		}
+	}
+
+	for _, header := range auth.ResponseHeaders {
+		if !headerName.MatchString(header) {
+			return fmt.Errorf("invalid header name %q", header)
+		}
+	}
+
+	return nil
+}
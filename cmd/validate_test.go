@@ -0,0 +1,596 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stephenafamo/warden/models"
+)
+
+// testConfig builds the config of a service named api in site.toml
+// from the contents of its table
+func testConfig(t *testing.T, content string) ConfigTemplateStruct {
+	t.Helper()
+
+	s := &models.Service{ID: 1, Name: "api", Content: content}
+	s.R = s.R.NewStruct()
+	s.R.File = &models.File{Name: "site", Path: "/docker/config/site.toml"}
+
+	return getFullConfig(s)
+}
+
+// withSettings uses the settings until the returned function is called
+func withSettings(s Settings) func() {
+	old := getSettings()
+	setSettings(s)
+
+	return func() { setSettings(old) }
+}
+
+// writeTestCa writes a self-signed CA certificate to a temporary directory
+func writeTestCa(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "warden")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "warden test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestValidateConfig(t *testing.T) {
+	caFile, cleanup := writeTestCa(t)
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		content string
+		err     string // part of the error, empty if the config is valid
+	}{
+		{
+			name: "http",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]`,
+		},
+		{
+			name: "error page",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				ErrorPages = {"502" = {Html = "<p>down</p>"}}`,
+		},
+		{
+			name: "error page for a success status",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				ErrorPages = {"200" = {File = "/200.html"}}`,
+			err: "invalid error page status code",
+		},
+		{
+			name: "error page with a file and html",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				ErrorPages = {"502" = {File = "/502.html", Html = "<p>down</p>"}}`,
+			err: "exactly one of File or Html",
+		},
+		{
+			name: "error page without a file or html",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				ErrorPages = {"502" = {}}`,
+			err: "exactly one of File or Html",
+		},
+		{
+			name: "maintenance",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Maintenance = true
+				MaintenanceAllow = ["10.0.0.1", "192.168.0.0/16"]`,
+		},
+		{
+			name: "maintenance with an invalid address",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Maintenance = true
+				MaintenanceAllow = ["office"]`,
+			err: "invalid IP address",
+		},
+		{
+			name: "listen on 443",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Listen = [{Port = 443}]`,
+			err: "cannot listen on port 443",
+		},
+		{
+			name: "listen on an invalid address",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Listen = [{Address = "localhost", Port = 8080}]`,
+			err: "invalid listen address",
+		},
+		{
+			name: "tcp",
+			content: `Type = "tcp"
+				Port = 5432
+				Upstream = [{Address = "db:5432"}]`,
+		},
+		{
+			name: "tcp without a port",
+			content: `Type = "tcp"
+				Upstream = [{Address = "db:5432"}]`,
+			err: "a port is required",
+		},
+		{
+			name: "grpc on port 80",
+			content: `Type = "grpc"
+				Domains = ["api.example.com"]
+				Upstream = [{Address = "api:50051"}]`,
+			err: "needs its own port",
+		},
+		{
+			name: "grpc on a shared plain text port",
+			content: `Type = "grpc"
+				Domains = ["api.example.com"]
+				Upstream = [{Address = "api:50051"}]
+				Listen = [{Port = 80, Http2 = true}]`,
+			err: "can not be served over plain text on port 80",
+		},
+		{
+			name: "grpc on a plain text port without http2",
+			content: `Type = "grpc"
+				Domains = ["api.example.com"]
+				Upstream = [{Address = "api:50051"}]
+				Listen = [{Port = 50051}]`,
+			err: "needs Http2",
+		},
+		{
+			name: "grpc on its own plain text port",
+			content: `Type = "grpc"
+				Domains = ["api.example.com"]
+				Upstream = [{Address = "api:50051"}]
+				Listen = [{Port = 50051, Http2 = true}]`,
+		},
+		{
+			name: "grpc over https only",
+			content: `Type = "grpc"
+				Domains = ["api.example.com"]
+				Upstream = [{Address = "api:50051"}]
+				Ssl = true
+				SslSource = "manual"
+				HttpsOnly = true`,
+		},
+		{
+			name: "fastcgi",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "php:9000"}]
+				Protocol = "fastcgi"
+				Root = "/var/www"`,
+		},
+		{
+			name: "fastcgi without root",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "php:9000"}]
+				Protocol = "fastcgi"`,
+			err: "a Root is required",
+		},
+		{
+			name: "unknown protocol",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Protocol = "ftp"`,
+			err: "unknown protocol",
+		},
+		{
+			name: "rate limit",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				RateLimit = {Rate = "10r/s", Burst = 20, Status = 429}`,
+		},
+		{
+			name: "rate limit with an invalid rate",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				RateLimit = {Rate = "10/s"}`,
+			err: "invalid rate",
+		},
+		{
+			name: "rate limit with a success status",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				RateLimit = {Rate = "10r/s", Status = 200}`,
+			err: "invalid rate limit status",
+		},
+		{
+			name: "cors",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Cors = {AllowOrigins = ["https://app.example.com", "https://*.example.org"], AllowCredentials = true}`,
+		},
+		{
+			name: "cors for every origin",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Cors = {AllowOrigins = ["*"]}`,
+		},
+		{
+			name: "cors with credentials for every origin",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Cors = {AllowOrigins = ["*"], AllowCredentials = true}`,
+			err: "can not allow credentials for every origin",
+		},
+		{
+			name: "cors origin without a scheme",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Cors = {AllowOrigins = ["app.example.com"]}`,
+			err: "must include the scheme",
+		},
+		{
+			name: "cache",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Cache = {Valid = {"200" = "10m"}}`,
+		},
+		{
+			name: "cache for fastcgi",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "php:9000"}]
+				Protocol = "fastcgi"
+				Root = "/var/www"
+				Cache = {Valid = {"200" = "10m"}}`,
+			err: "caching is not supported for fastcgi",
+		},
+		{
+			name: "cache for uwsgi",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "app:3031"}]
+				Protocol = "uwsgi"
+				Cache = {Valid = {"200" = "10m"}}`,
+			err: "caching is not supported for uwsgi",
+		},
+		{
+			name: "split 91.8 and 8.2",
+			content: `Domains = ["api.example.com"]
+				[Split]
+				Groups = [
+					{Name = "stable", Weight = 91.8, Upstream = [{Address = "stable:80"}]},
+					{Name = "canary", Weight = 8.2, Upstream = [{Address = "canary:80"}]},
+				]`,
+		},
+		{
+			name: "split 66.66 and 33.34",
+			content: `Domains = ["api.example.com"]
+				[Split]
+				Groups = [
+					{Name = "stable", Weight = 66.66, Upstream = [{Address = "stable:80"}]},
+					{Name = "canary", Weight = 33.34, Upstream = [{Address = "canary:80"}]},
+				]`,
+		},
+		{
+			name: "split 95.65 and 4.35",
+			content: `Domains = ["api.example.com"]
+				[Split]
+				Groups = [
+					{Name = "stable", Weight = 95.65, Upstream = [{Address = "stable:80"}]},
+					{Name = "canary", Weight = 4.35, Upstream = [{Address = "canary:80"}]},
+				]`,
+		},
+		{
+			name: "split 98.85 and 1.15",
+			content: `Domains = ["api.example.com"]
+				[Split]
+				Groups = [
+					{Name = "stable", Weight = 98.85, Upstream = [{Address = "stable:80"}]},
+					{Name = "canary", Weight = 1.15, Upstream = [{Address = "canary:80"}]},
+				]`,
+		},
+		{
+			name: "split 99.93 and 0.07",
+			content: `Domains = ["api.example.com"]
+				[Split]
+				Groups = [
+					{Name = "stable", Weight = 99.93, Upstream = [{Address = "stable:80"}]},
+					{Name = "canary", Weight = 0.07, Upstream = [{Address = "canary:80"}]},
+				]`,
+		},
+		{
+			name: "split 97.99 and 2.01",
+			content: `Domains = ["api.example.com"]
+				[Split]
+				Groups = [
+					{Name = "stable", Weight = 97.99, Upstream = [{Address = "stable:80"}]},
+					{Name = "canary", Weight = 2.01, Upstream = [{Address = "canary:80"}]},
+				]`,
+		},
+		{
+			name: "split with 3 decimal places",
+			content: `Domains = ["api.example.com"]
+				[Split]
+				Groups = [
+					{Name = "stable", Weight = 66.667, Upstream = [{Address = "stable:80"}]},
+					{Name = "canary", Weight = 33.333, Upstream = [{Address = "canary:80"}]},
+				]`,
+			err: "at most 2 decimal places",
+		},
+		{
+			name: "split not adding up to 100",
+			content: `Domains = ["api.example.com"]
+				[Split]
+				Groups = [
+					{Name = "stable", Weight = 90, Upstream = [{Address = "stable:80"}]},
+					{Name = "canary", Weight = 5, Upstream = [{Address = "canary:80"}]},
+				]`,
+			err: "add up to 95, not 100",
+		},
+		{
+			name: "split with an upstream",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Split = {Groups = [{Name = "a", Weight = 50, Upstream = [{Address = "a:80"}]}, {Name = "b", Weight = 50, Upstream = [{Address = "b:80"}]}]}`,
+			err: "can not have both an Upstream and a Split",
+		},
+		{
+			name: "blue green",
+			content: `Domains = ["api.example.com"]
+				[BlueGreen]
+				Active = "blue"
+				Colors = {blue = {Upstream = [{Address = "api-blue:80"}]}, green = {Upstream = [{Address = "api-green:80"}]}}`,
+		},
+		{
+			name: "blue green with one color",
+			content: `Domains = ["api.example.com"]
+				[BlueGreen]
+				Active = "blue"
+				Colors = {blue = {Upstream = [{Address = "api-blue:80"}]}}`,
+			err: "at least 2 colors",
+		},
+		{
+			name: "sticky",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api-1:80"}, {Address = "api-2:80"}]
+				Sticky = {Cookie = "route", Secure = true}`,
+		},
+		{
+			name: "sticky without a cookie or header",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api-1:80"}, {Address = "api-2:80"}]
+				Sticky = {Secure = true}`,
+			err: "need either a Cookie or a Header",
+		},
+		{
+			name: "sticky with a balancing option",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api-1:80"}, {Address = "api-2:80"}]
+				UpstreamOptions = {least_conn = ""}
+				Sticky = {Cookie = "route"}`,
+			err: "least_conn can not be used with sticky sessions",
+		},
+		{
+			name: "access log",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				AccessLog = {Path = "/var/log/nginx/services/api.log"}`,
+		},
+		{
+			name: "access log replacing access.log",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				AccessLog = {Path = "/var/log/nginx/access.log"}`,
+			err: "must be in /var/log/nginx/services",
+		},
+		{
+			name: "access log outside of the services directory",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				AccessLog = {Path = "/var/log/nginx/services/../error.log"}`,
+			err: "must be in /var/log/nginx/services",
+		},
+		{
+			name: "retry http_502 for fastcgi",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "php:9000"}]
+				Protocol = "fastcgi"
+				Root = "/var/www"
+				Retry = {Conditions = ["error", "http_502"]}`,
+			err: "http_502 can not be used with fastcgi",
+		},
+		{
+			name: "retry http_503 for fastcgi",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "php:9000"}]
+				Protocol = "fastcgi"
+				Root = "/var/www"
+				Retry = {Conditions = ["error", "http_503"], Tries = 2}`,
+		},
+		{
+			name: "retry off with other conditions",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Retry = {Conditions = ["off", "error"]}`,
+			err: "off can not be used with other conditions",
+		},
+		{
+			name: "timeouts also in options",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Timeouts = {Read = "30s"}
+				LocationOptions = {proxy_read_timeout = "10s"}`,
+			err: "proxy_read_timeout can not be in the Options",
+		},
+		{
+			name: "retry also in options",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Retry = {Tries = 2}
+				LocationOptions = {proxy_next_upstream_tries = "3"}`,
+			err: "proxy_next_upstream_tries can not be in the Options",
+		},
+		{
+			name: "other timeout in options",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Timeouts = {Read = "30s"}
+				LocationOptions = {proxy_connect_timeout = "2s"}`,
+		},
+		{
+			name: "client auth without https only",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				ClientAuth = {CaFile = "` + caFile + `"}`,
+			err: "ClientAuth needs Ssl and HttpsOnly",
+		},
+		{
+			name: "client auth without a ca file",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				HttpsOnly = true
+				ClientAuth = {Verify = "optional"}`,
+			err: "a CaFile is needed",
+		},
+		{
+			name: "client auth with an unknown verification",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				HttpsOnly = true
+				ClientAuth = {CaFile = "` + caFile + `", Verify = "maybe"}`,
+			err: "invalid client certificate verification",
+		},
+		{
+			name: "client auth",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				HttpsOnly = true
+				ClientAuth = {CaFile = "` + caFile + `"}`,
+		},
+		{
+			name: "tcp upstream tls verify without server name",
+			content: `Type = "tcp"
+				Port = 5432
+				Upstream = [{Address = "db:5432"}]
+				UpstreamTls = {Verify = true, CaFile = "` + caFile + `"}`,
+			err: "a ServerName is needed",
+		},
+		{
+			name: "upstream tls for fastcgi",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "php:9000"}]
+				Protocol = "fastcgi"
+				Root = "/var/www"
+				UpstreamTls = {Verify = true}`,
+			err: "TLS to the upstream is not supported for fastcgi",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateConfig(testConfig(t, test.content))
+
+			if test.err == "" && err != nil {
+				t.Fatalf("expected no error, got %q", err)
+			}
+
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("expected an error with %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestValidateProxyProtocol(t *testing.T) {
+	defer withSettings(Settings{
+		ProxyProtocol: true,
+		RealIpFrom:    []string{"10.0.0.1"},
+	})()
+
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			name: "internal https port",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"`,
+		},
+		{
+			name: "own https port without the proxy protocol",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				Listen = [{Port = 8443, Ssl = true}]`,
+			err: "set ProxyProtocol on its Listen",
+		},
+		{
+			name: "own https port with the proxy protocol",
+			content: `Domains = ["api.example.com"]
+				Upstream = [{Address = "api:80"}]
+				Ssl = true
+				SslSource = "manual"
+				Listen = [{Port = 8443, Ssl = true, ProxyProtocol = true}]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateConfig(testConfig(t, test.content))
+
+			if test.err == "" && err != nil {
+				t.Fatalf("expected no error, got %q", err)
+			}
+
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("expected an error with %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,7 +29,7 @@ func WalkConfigDirectory(db *sql.DB) {
 	var ctx = context.Background()
 
 	err := filepath.Walk(
-		settings.ConfigDir,
+		getSettings().ConfigDir,
 		setFilesInfo(&filepaths, &files),
 	)
 	if err != nil {
@@ -98,8 +99,18 @@ func GenerateNginxConfig(db *sql.DB) {
 	}
 
 	if len(nginxFiles) > 0 {
+		logsInUse, err := accessLogsInUse(db)
+		if err != nil {
+			panic(err)
+		}
+
 		for _, file := range nginxFiles {
 			defer r(db)
+			// Keep the logs of services that were only modified
+			if file.Type == "log" && logsInUse[file.Path] {
+				continue
+			}
+
 			c := exec.Command("rm", "-f", file.Path)
 			err = c.Run()
 			if err != nil {
@@ -119,14 +130,29 @@ func GenerateNginxConfig(db *sql.DB) {
 	}
 
 	if len(services) > 0 {
+		conflicts, err := defaultServerConflicts(db, services)
+		if err != nil {
+			panic(err)
+		}
+
 		for _, service := range services {
+			if err := conflicts[service.ID]; err != nil {
+				log.Printf(
+					"Invalid config for service %q in file %q: %s\n",
+					service.Name,
+					service.R.File.Path,
+					err,
+				)
+				continue
+			}
+
 			wg.Add(1)
 			go generateBaseConfig(db, service, &wg)
 		}
 
 		wg.Wait()
 
-		err = reloadNginx()
+		err = refreshNginx(db)
 		if err != nil {
 			panic(err)
 		}
@@ -146,7 +172,7 @@ func GenerateNginxConfig(db *sql.DB) {
 			generateHttpsConfig(db, service) 
 		}
 
-		err = reloadNginx()
+		err = refreshNginx(db)
 		if err != nil {
 			panic(err)
 		}
@@ -168,7 +194,7 @@ func GenerateNginxConfig(db *sql.DB) {
 
 		wg.Wait()
 
-		err = reloadNginx()
+		err = refreshNginx(db)
 		if err != nil {
 			panic(err)
 		}
@@ -187,18 +213,274 @@ func getFullConfig(s *models.Service) ConfigTemplateStruct {
 		config.Type = "http"
 	}
 
+	// gRPC services are HTTP services with a different default protocol
+	if strings.ToLower(config.Type) == "grpc" {
+		config.Type = "http"
+		if config.Protocol == "" {
+			config.Protocol = "grpc"
+		}
+	}
+
+	if config.Protocol == "" {
+		config.Protocol = "http"
+	}
+
 	if config.Location == "" && len(config.Locations) == 0 {
 		config.Location = "/"
 	}
 
+	if config.ClientAuth != nil {
+		config.ClientAuth = clientAuthWithDefaults(*config.ClientAuth)
+	}
+
+	if config.AccessLog != nil && config.AccessLog.Path == "" {
+		config.AccessLog.Path = defaultAccessLogPath(s.R.File.Name, s.Name)
+	}
+
 	tStruct := ConfigTemplateStruct{
 		ServiceConfig: config,
 		Unique:        s.Name + "-" + s.R.File.Name + "-" + strconv.FormatInt(s.ID, 10),
 	}
+	tStruct.Variable = nginxVariableName(tStruct.Unique)
+	if config.BlueGreen != nil {
+		tStruct.ActiveColor, err = getActiveColor(s, *config.BlueGreen)
+		if err != nil {
+			// A panic would purge the config of every service
+			log.Printf("Using the Active color of %q in %q: %s\n", s.Name, s.R.File.Path, err)
+			tStruct.ActiveColor = config.BlueGreen.Active
+		}
+	}
+	tStruct.CacheZone = "warden_cache_" + nginxVariableName(s.R.File.Name+"_"+s.Name)
+	tStruct.CachePath = filepath.Join(
+		cacheDir,
+		cacheDirName(s.R.File.Name),
+		cacheDirName(s.Name),
+	)
+	tStruct.Access = resolveAccessControl(config.Access)
+	tStruct.ErrorPageFiles = getErrorPageFiles(tStruct)
+	tStruct.AllLocations = getAllLocations(tStruct)
+	for _, location := range tStruct.AllLocations {
+		tStruct.Grpc = tStruct.Grpc || location.IsGrpc()
+	}
+	setListenDirectives(&tStruct)
 
 	return tStruct
 }
 
+var nonVariableChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// nginxVariableName makes a string usable as part of an nginx variable name
+func nginxVariableName(s string) string {
+	return nonVariableChars.ReplaceAllString(s, "_")
+}
+
+// getAllLocations puts the main location and the extra locations of
+// a service in a single list so they can be rendered the same way
+func getAllLocations(config ConfigTemplateStruct) []LocationTemplateStruct {
+	var locations []LocationTemplateStruct
+
+	if config.Location != "" {
+		upstream, upstreamOptions := config.Upstream, config.UpstreamOptions
+		if config.BlueGreen != nil {
+			set := config.BlueGreen.Colors[config.ActiveColor]
+			upstream, upstreamOptions = set.Upstream, set.UpstreamOptions
+		}
+
+		locations = append(locations, LocationTemplateStruct{
+			Location: Location{
+				Match:           config.Location,
+				StripPrefix:     config.StripPrefix,
+				AddPrefix:       config.AddPrefix,
+				Rewrites:        config.Rewrites,
+				Split:           config.Split,
+				Sticky:          config.Sticky,
+				Options:         config.LocationOptions,
+				Upstream:        upstream,
+				UpstreamOptions: upstreamOptions,
+			},
+			Unique: config.Unique,
+		})
+	}
+
+	for i, location := range config.Locations {
+		locations = append(locations, LocationTemplateStruct{
+			Location: location,
+			Unique:   config.Unique + "-" + strconv.Itoa(i),
+		})
+	}
+
+	for i := range locations {
+		inheritServiceConfig(&locations[i], config)
+	}
+
+	return locations
+}
+
+// inheritServiceConfig sets the settings a location does not
+// override to the ones of its service
+func inheritServiceConfig(location *LocationTemplateStruct, config ConfigTemplateStruct) {
+	location.Variable = config.Variable
+	location.Maintenance = config.Maintenance
+	location.Ssl = config.Ssl
+	location.ErrorPageFiles = config.ErrorPageFiles
+	location.ClientAuth = config.ClientAuth
+
+	if location.Protocol == "" {
+		location.Protocol = config.Protocol
+	}
+	location.Protocol = strings.ToLower(location.Protocol)
+
+	if location.UpstreamTls == nil {
+		location.UpstreamTls = config.UpstreamTls
+	}
+
+	if location.UpstreamTls != nil && location.UpstreamTls.Disable {
+		location.UpstreamTls = nil
+	}
+
+	// UpstreamTls also changes the scheme
+	if location.UpstreamTls != nil {
+		switch location.Protocol {
+		case "http":
+			location.Protocol = "https"
+		case "grpc":
+			location.Protocol = "grpcs"
+		}
+	}
+
+	if location.Root == "" {
+		location.Root = config.Root
+	}
+
+	if location.Index == "" {
+		location.Index = config.Index
+	}
+
+	if location.Index == "" && location.Protocol == "fastcgi" {
+		location.Index = "index.php"
+	}
+
+	if location.Auth == nil {
+		location.Auth = config.Auth
+	}
+
+	if location.Cors == nil {
+		location.Cors = config.Cors
+	}
+
+	if location.Cors != nil && len(location.Cors.AllowMethods) == 0 {
+		cors := *location.Cors
+		cors.AllowMethods = defaultCorsMethods
+		location.Cors = &cors
+	}
+
+	if location.SecurityHeaders == nil {
+		location.SecurityHeaders = config.SecurityHeaders
+	}
+
+	// With Sticky, clients have to stay in the same group too
+	if location.Split != nil && location.Split.Key == "" {
+		split := *location.Split
+		split.Key = "$request_id"
+		if location.Sticky != nil {
+			split.Key = location.StickyKey()
+		}
+		location.Split = &split
+	}
+
+	location.HeaderRules = mergeHeaderRules(config.HeaderRules, location.HeaderRules)
+
+	if location.Compression == nil {
+		location.Compression = config.Compression
+	}
+
+	location.MirrorUpstream = location.Unique + ".mirror"
+	if location.Mirror == nil {
+		location.Mirror = config.Mirror
+		location.MirrorUpstream = config.Unique + ".mirror"
+	}
+
+	if location.Mirror != nil && location.Mirror.Disable {
+		location.Mirror = nil
+	}
+
+	if location.Mirror != nil && location.Mirror.Timeout == "" {
+		mirror := *location.Mirror
+		mirror.Timeout = "5s"
+		location.Mirror = &mirror
+	}
+
+	if location.Timeouts == nil {
+		location.Timeouts = config.Timeouts
+	}
+
+	if location.Retry == nil {
+		location.Retry = config.Retry
+	}
+
+	location.CacheZone = config.CacheZone
+	if location.Cache == nil {
+		location.Cache = config.Cache
+	}
+
+	if location.Cache != nil && location.Cache.Disable {
+		location.Cache = nil
+	}
+
+	if location.Cache != nil && location.Cache.Key == "" {
+		cache := *location.Cache
+		cache.Key = defaultCacheKey
+		location.Cache = &cache
+	}
+
+	location.RateLimitZone = rateLimitZone(location.Unique)
+	if location.RateLimit == nil {
+		location.RateLimit = config.RateLimit
+		location.RateLimitZone = rateLimitZone(config.Unique)
+	}
+
+	location.Access = resolveAccessControl(location.Access)
+	if location.Access == nil {
+		location.Access = config.Access
+	}
+
+	location.HtpasswdPath = filepath.Join(htpasswdDir, location.Unique)
+	if location.BasicAuth == nil {
+		location.BasicAuth = config.BasicAuth
+		location.HtpasswdPath = filepath.Join(htpasswdDir, config.Unique)
+	}
+
+	if location.BasicAuth != nil && location.BasicAuth.Realm == "" {
+		basicAuth := *location.BasicAuth
+		basicAuth.Realm = "Restricted"
+		location.BasicAuth = &basicAuth
+	}
+
+	if location.RateLimit != nil && location.RateLimit.Key == "" {
+		rateLimit := *location.RateLimit
+		rateLimit.Key = "$binary_remote_addr"
+		location.RateLimit = &rateLimit
+	}
+}
+
+// getErrorPageFiles returns the file to serve for each error page.
+// Inline pages are written to the pages directory when configuring
+func getErrorPageFiles(config ConfigTemplateStruct) map[string]string {
+	files := make(map[string]string, len(config.ErrorPages))
+
+	for code, page := range config.ErrorPages {
+		files[code] = page.File
+		if page.Html != "" {
+			files[code] = filepath.Join(
+				"/etc/nginx/conf.d/pages",
+				config.Unique+"."+code+".html",
+			)
+		}
+	}
+
+	return files
+}
+
 func generateBaseConfig(db *sql.DB, s *models.Service, wg *sync.WaitGroup) {
 	defer r(db)
 	defer wg.Done()
@@ -209,6 +491,20 @@ func generateBaseConfig(db *sql.DB, s *models.Service, wg *sync.WaitGroup) {
 
 	config := getFullConfig(s)
 
+	// Invalid configs may not render, or render something nginx rejects
+	err = validateConfig(config)
+	if err != nil {
+		log.Printf(
+			"Invalid config for service %q in file %q: %s\n",
+			s.Name,
+			s.R.File.Path,
+			err,
+		)
+		return
+	}
+
+	pingMirrors(&config, s)
+
 	configDirectory := ""
 	fileType := ""
 	configContents := []byte{}
@@ -250,6 +546,61 @@ func generateBaseConfig(db *sql.DB, s *models.Service, wg *sync.WaitGroup) {
 		return
 	}
 
+	for code, page := range config.ErrorPages {
+		if page.Html == "" {
+			continue
+		}
+
+		pagePath := config.ErrorPageFiles[code]
+		err = ioutil.WriteFile(pagePath, []byte(page.Html), 0644)
+		if err != nil {
+			panic(err)
+		}
+
+		err = s.AddNginxConfigFiles(ctx, db, true, &models.NginxConfigFile{
+			Type:         "page",
+			Path:         pagePath,
+			LastModified: s.LastModified,
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	htpasswdFiles := map[string]bool{}
+	for _, location := range config.AllLocations {
+		if location.BasicAuth == nil || htpasswdFiles[location.HtpasswdPath] {
+			continue
+		}
+		htpasswdFiles[location.HtpasswdPath] = true
+
+		contents, err := htpasswdContents(*location.BasicAuth)
+		if err != nil {
+			panic(err)
+		}
+
+		err = ioutil.WriteFile(location.HtpasswdPath, contents, 0644)
+		if err != nil {
+			panic(err)
+		}
+
+		err = s.AddNginxConfigFiles(ctx, db, true, &models.NginxConfigFile{
+			Type:         "htpasswd",
+			Path:         location.HtpasswdPath,
+			LastModified: s.LastModified,
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if config.AccessLog != nil {
+		err = trackAccessLog(ctx, db, s, config.AccessLog.Path)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	configPath := filepath.Join(configDirectory, config.Unique+".conf")
 	err = ioutil.WriteFile(configPath, configContents, 0644)
 	if err != nil {
@@ -288,6 +639,7 @@ func generateHttpsConfig(db *sql.DB, s *models.Service) {
 	var ctx = context.Background()
 
 	config := getFullConfig(s)
+	removeUnreachableMirrors(&config)
 
 	err = setSslCertificatePath(&config)
 	if err != nil {
@@ -320,6 +672,29 @@ func generateHttpsConfig(db *sql.DB, s *models.Service) {
 		panic(err)
 	}
 
+	if config.SniUpstream != "" {
+		var sni bytes.Buffer
+		err = t.ExecuteTemplate(&sni, "sni", config)
+		if err != nil {
+			panic(err)
+		}
+
+		sniPath := filepath.Join("/etc/nginx/conf.d/sni", config.Unique+".conf")
+		err = ioutil.WriteFile(sniPath, sni.Bytes(), 0644)
+		if err != nil {
+			panic(err)
+		}
+
+		err = s.AddNginxConfigFiles(ctx, db, true, &models.NginxConfigFile{
+			Type:         "sni",
+			Path:         sniPath,
+			LastModified: s.LastModified,
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	s.State = stateConfigured
 	if config.HttpsOnly {
 		s.State = stateToDisableHttp
@@ -342,6 +717,7 @@ func redirectToHttpsConfig(db *sql.DB, s *models.Service, wg *sync.WaitGroup) {
 	var ctx = context.Background()
 
 	config := getFullConfig(s)
+	removeUnreachableMirrors(&config)
 
 	ngf, err := s.NginxConfigFiles(
 		models.NginxConfigFileWhere.Type.EQ("http"),
@@ -369,19 +745,20 @@ func redirectToHttpsConfig(db *sql.DB, s *models.Service, wg *sync.WaitGroup) {
 }
 
 func pingUpstreams(config ConfigTemplateStruct) (bool, string) {
-	for _, u := range config.Upstream {
-		host := strings.Split(u.Address, ":")[0]
-
-		log.Printf("PINGING %q\n", host)
-
-		cmd := exec.Command("ping", "-c", "1", host)
-		err := cmd.Run()
-		if err != nil {
-			return false, host
+	upstream := config.Upstream
+	if config.Split != nil {
+		for _, group := range config.Split.Groups {
+			upstream = append(upstream, group.Upstream...)
 		}
 	}
 
-	return true, ""
+	// Only the active color gets traffic. The others are checked
+	// by checkBlueGreenColors and when they are switched to
+	if config.BlueGreen != nil {
+		upstream = append(upstream, config.BlueGreen.Colors[config.ActiveColor].Upstream...)
+	}
+
+	return pingServers(upstream)
 }
 
 func setSslCertificatePath(config *ConfigTemplateStruct) error {
@@ -399,6 +776,4 @@ func setSslCertificatePath(config *ConfigTemplateStruct) error {
 	default:
 		return fmt.Errorf("Unknown SSL source %q", config.SslSource)
 	}
-
-	return nil
 }
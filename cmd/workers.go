@@ -27,7 +27,7 @@ func r(db *sql.DB) {
 }
 
 func startConfigDirectoryWatcher(db *sql.DB) error {
-	duration, err := time.ParseDuration(settings.ReloadDuration)
+	duration, err := time.ParseDuration(getSettings().ReloadDuration)
 	if err != nil {
 		return err
 	}
@@ -43,7 +43,7 @@ func startConfigDirectoryWatcher(db *sql.DB) error {
 }
 
 func startFileServicesConfigurator(db *sql.DB) error {
-	duration, err := time.ParseDuration(settings.ReloadDuration)
+	duration, err := time.ParseDuration(getSettings().ReloadDuration)
 	if err != nil {
 		return err
 	}
@@ -58,7 +58,7 @@ func startFileServicesConfigurator(db *sql.DB) error {
 }
 
 func startServicesNginxConfigGenerator(db *sql.DB) error {
-	duration, err := time.ParseDuration(settings.ReloadDuration)
+	duration, err := time.ParseDuration(getSettings().ReloadDuration)
 	if err != nil {
 		return err
 	}
@@ -72,6 +72,21 @@ func startServicesNginxConfigGenerator(db *sql.DB) error {
 	return nil
 }
 
+func startBlueGreenHealthChecker(db *sql.DB) error {
+	duration, err := time.ParseDuration(getSettings().HealthCheck)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(duration)
+	go func() {
+		for _ = range ticker.C {
+			checkBlueGreenColors(db)
+		}
+	}()
+	return nil
+}
+
 func setFilesInfo(filepaths *[]interface{}, files *[]FilePathAndInfo) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if info.IsDir() {